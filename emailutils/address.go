@@ -0,0 +1,250 @@
+/*
+Address validation for emailutils.
+
+Addresses are checked as they're added to a message, so that a typo shows
+up straight away rather than as a rejection from the SMTP server. Either a
+bare address or the 'Name <addr>' form may be used:
+
+	err := email.AddRecipient("Ops Team <ops@example.com>")
+
+Internationalised domain names, such as 'user@bücher.example', are accepted
+and converted to their ASCII (punycode) form when the message is sent.
+
+Optionally, the domain of each address can be checked for MX records before
+sending, by adding 'check_mx=yes' to the config or calling CheckMX()
+directly. Lookups go through DefaultResolver, which can be replaced - for
+example, to avoid DNS traffic in tests.
+*/
+
+package emailutils
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/mail"
+	"strings"
+	"unicode/utf8"
+)
+
+// Resolver looks up MX records. *net.Resolver satisfies this interface.
+type Resolver interface {
+	LookupMX(ctx context.Context, name string) ([]*net.MX, error)
+}
+
+// DefaultResolver is used for MX checks when sending with check_mx=yes.
+var DefaultResolver Resolver = net.DefaultResolver
+
+// ParseAddress() checks an address, in either bare or 'Name <addr>' form.
+// The domain in the result is in ASCII, converted from an internationalised
+// domain name if necessary.
+func ParseAddress(addr string) (*mail.Address, error) {
+	parsed, err := mail.ParseAddress(strings.TrimSpace(addr))
+	if err != nil {
+		return nil, errors.New("invalid address: " + strings.TrimPrefix(err.Error(), "mail: "))
+	}
+	at := strings.LastIndex(parsed.Address, "@")
+	local, domain := parsed.Address[:at], parsed.Address[at+1:]
+	if len(local) > 64 {
+		return nil, errors.New("invalid address: local part longer than 64 characters")
+	}
+	if domain, err = asciiDomain(domain); err != nil {
+		return nil, err
+	}
+	parsed.Address = local + "@" + domain
+	return parsed, nil
+}
+
+// asciiDomain() checks a domain name, converting any internationalised
+// labels to punycode.
+func asciiDomain(domain string) (string, error) {
+	if strings.HasPrefix(domain, "[") {
+		// an address literal, eg [192.0.2.1]
+		if net.ParseIP(strings.TrimPrefix(strings.Trim(domain, "[]"), "IPv6:")) == nil {
+			return "", errors.New("invalid address: bad domain literal " + domain)
+		}
+		return domain, nil
+	}
+	labels := strings.Split(strings.TrimSuffix(domain, "."), ".")
+	for i, label := range labels {
+		if !isASCII(label) {
+			label = "xn--" + punycode(strings.ToLower(label))
+		}
+		if len(label) == 0 || len(label) > 63 {
+			return "", errors.New("invalid address: bad domain " + domain)
+		}
+		for j := 0; j < len(label); j++ {
+			c := label[j]
+			ok := c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' ||
+				c == '-' && j > 0 && j < len(label)-1
+			if !ok {
+				return "", errors.New("invalid address: bad domain " + domain)
+			}
+		}
+		labels[i] = label
+	}
+	ascii := strings.Join(labels, ".")
+	if len(ascii) > 253 {
+		return "", errors.New("invalid address: domain longer than 253 characters")
+	}
+	return ascii, nil
+}
+
+// isASCII() reports whether a string is entirely ASCII.
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= utf8.RuneSelf {
+			return false
+		}
+	}
+	return true
+}
+
+// punycode() encodes a domain label as per RFC 3492, without the 'xn--'
+// prefix.
+func punycode(label string) string {
+	const (
+		base        = 36
+		tMin        = 1
+		tMax        = 26
+		skew        = 38
+		damp        = 700
+		initialBias = 72
+		initialN    = 128
+	)
+	digit := func(d int) byte {
+		if d < 26 {
+			return byte('a' + d)
+		}
+		return byte('0' + d - 26)
+	}
+	adapt := func(delta int, numPoints int, first bool) int {
+		if first {
+			delta /= damp
+		} else {
+			delta /= 2
+		}
+		delta += delta / numPoints
+		k := 0
+		for delta > ((base-tMin)*tMax)/2 {
+			delta /= base - tMin
+			k += base
+		}
+		return k + (base-tMin+1)*delta/(delta+skew)
+	}
+	runes := []rune(label)
+	out := []byte{}
+	for _, r := range runes {
+		if r < initialN {
+			out = append(out, byte(r))
+		}
+	}
+	basic := len(out)
+	handled := basic
+	if basic > 0 {
+		out = append(out, '-')
+	}
+	n, delta, bias := initialN, 0, initialBias
+	for handled < len(runes) {
+		// the smallest code point not yet handled
+		m := int(^uint(0) >> 1)
+		for _, r := range runes {
+			if int(r) >= n && int(r) < m {
+				m = int(r)
+			}
+		}
+		delta += (m - n) * (handled + 1)
+		n = m
+		for _, r := range runes {
+			if int(r) < n {
+				delta++
+			}
+			if int(r) != n {
+				continue
+			}
+			q := delta
+			for k := base; ; k += base {
+				t := k - bias
+				if t < tMin {
+					t = tMin
+				} else if t > tMax {
+					t = tMax
+				}
+				if q < t {
+					break
+				}
+				out = append(out, digit(t+(q-t)%(base-t)))
+				q = (q - t) / (base - t)
+			}
+			out = append(out, digit(q))
+			bias = adapt(delta, handled+1, handled == basic)
+			delta = 0
+			handled++
+		}
+		delta++
+		n++
+	}
+	return string(out)
+}
+
+// checkAddress() validates an address for the named header field.
+func checkAddress(field string, addr string) error {
+	if _, err := ParseAddress(addr); err != nil {
+		return HeaderError{Field: field, Address: addr, Msg: err.Error()}
+	}
+	return nil
+}
+
+// CheckMX() makes sure the domain of every address in the header has MX
+// records, using the given Resolver (or DefaultResolver, if it's nil). A
+// domain that explicitly accepts no mail (a 'null MX') fails the check.
+func (hdr EmailHeader) CheckMX(ctx context.Context, r Resolver) error {
+	if r == nil {
+		r = DefaultResolver
+	}
+	var errs HeaderErrors
+	checked := map[string]error{}
+	check := func(field string, addrs []string) {
+		for _, addr := range addrs {
+			parsed, err := ParseAddress(addr)
+			if err != nil {
+				errs = append(errs, HeaderError{Field: field, Address: addr, Msg: err.Error()})
+				continue
+			}
+			domain := strings.ToLower(parsed.Address[strings.LastIndex(parsed.Address, "@")+1:])
+			if _, done := checked[domain]; !done {
+				checked[domain] = lookupMX(ctx, r, domain)
+			}
+			if err = checked[domain]; err != nil {
+				errs = append(errs, HeaderError{Field: field, Address: addr, Msg: err.Error()})
+			}
+		}
+	}
+	check("From", []string{hdr.From})
+	check("To", hdr.To)
+	check("Cc", hdr.Cc)
+	check("Bcc", hdr.Bcc)
+	check("Reply-To", hdr.ReplyTo)
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// lookupMX() checks that a domain has usable MX records.
+func lookupMX(ctx context.Context, r Resolver, domain string) error {
+	if strings.HasPrefix(domain, "[") {
+		return nil // an address literal needs no lookup
+	}
+	mxs, err := r.LookupMX(ctx, domain)
+	if err != nil {
+		return errors.New("MX lookup for " + domain + " failed: " + err.Error())
+	}
+	if len(mxs) == 0 {
+		return errors.New("no MX records for " + domain)
+	}
+	if len(mxs) == 1 && (mxs[0].Host == "." || mxs[0].Host == "") {
+		return errors.New(domain + " does not accept email")
+	}
+	return nil
+}
@@ -0,0 +1,158 @@
+/*
+SMTP authentication for emailutils.
+
+The mechanism is chosen with the 'auth_method' config key:
+
+	auth_method=auto       pick the best mechanism the server offers (default)
+	auth_method=plain      AUTH PLAIN
+	auth_method=login      AUTH LOGIN
+	auth_method=cram-md5   AUTH CRAM-MD5
+	auth_method=xoauth2    AUTH XOAUTH2 - 'token' holds the OAuth2 bearer
+	                       token (if it's missing, 'pass' is used instead)
+	auth_method=none       don't authenticate at all
+
+Whatever the setting, the mechanism must be one the server advertises in
+its response to EHLO.
+*/
+
+package emailutils
+
+import (
+	"errors"
+	"net/smtp"
+	"strings"
+)
+
+// AuthMethods lists the valid values for the 'auth_method' config key.
+var AuthMethods = []string{"auto", "plain", "login", "cram-md5", "xoauth2", "none"}
+
+// loginAuth implements the (non-standard, but widely used) LOGIN mechanism.
+type loginAuth struct {
+	username string
+	password string
+	host     string
+}
+
+// Start() begins the LOGIN exchange. As with smtp.PlainAuth, the
+// credentials are only sent over TLS or to localhost.
+func (a *loginAuth) Start(server *smtp.ServerInfo) (string, []byte, error) {
+	if !server.TLS && !isLocalhost(server.Name) {
+		return "", nil, errors.New("unencrypted connection")
+	}
+	if server.Name != a.host {
+		return "", nil, errors.New("wrong host name")
+	}
+	return "LOGIN", nil, nil
+}
+
+// Next() answers the server's username and password prompts.
+func (a *loginAuth) Next(fromServer []byte, more bool) ([]byte, error) {
+	if !more {
+		return nil, nil
+	}
+	prompt := strings.ToLower(strings.TrimSpace(string(fromServer)))
+	switch {
+	case strings.HasPrefix(prompt, "user"):
+		return []byte(a.username), nil
+	case strings.HasPrefix(prompt, "pass"):
+		return []byte(a.password), nil
+	}
+	return nil, errors.New("unexpected LOGIN prompt: " + string(fromServer))
+}
+
+// xoauth2Auth implements the XOAUTH2 mechanism used by Google, Microsoft and
+// others, where the password is replaced by an OAuth2 bearer token.
+type xoauth2Auth struct {
+	username string
+	token    string
+}
+
+// Start() sends the initial response holding the user and token.
+func (a *xoauth2Auth) Start(server *smtp.ServerInfo) (string, []byte, error) {
+	if !server.TLS && !isLocalhost(server.Name) {
+		return "", nil, errors.New("unencrypted connection")
+	}
+	resp := "user=" + a.username + "\x01auth=Bearer " + a.token + "\x01\x01"
+	return "XOAUTH2", []byte(resp), nil
+}
+
+// Next() handles a failure. The server sends details of the error as a
+// challenge, which must be answered with an empty response before it
+// reports the failure.
+func (a *xoauth2Auth) Next(fromServer []byte, more bool) ([]byte, error) {
+	if more {
+		return []byte{}, nil
+	}
+	return nil, nil
+}
+
+// validAuthMethod() checks that a value for the 'auth_method' key is one
+// we know about.
+func validAuthMethod(method string) bool {
+	for _, m := range AuthMethods {
+		if m == method {
+			return true
+		}
+	}
+	return false
+}
+
+// isLocalhost() checks whether a server name refers to this machine.
+func isLocalhost(name string) bool {
+	return name == "localhost" || name == "127.0.0.1" || name == "::1"
+}
+
+// smtpAuth() chooses the authentication mechanism for a session, based on
+// the config map and the mechanisms advertised by the server. A nil Auth
+// means no authentication is required.
+func smtpAuth(c *smtp.Client, cfg map[string]string) (smtp.Auth, error) {
+	method := strings.ToLower(cfg["auth_method"])
+	if len(method) > 0 && !validAuthMethod(method) {
+		return nil, errors.New("Unknown auth_method: " + cfg["auth_method"])
+	}
+	if method == "none" || (len(method) == 0 && len(cfg["user"]) == 0) {
+		return nil, nil
+	}
+	ok, params := c.Extension("AUTH")
+	if !ok {
+		return nil, errors.New("server doesn't support AUTH")
+	}
+	offered := map[string]bool{}
+	for _, mech := range strings.Fields(strings.ToLower(params)) {
+		offered[mech] = true
+	}
+	if len(method) == 0 || method == "auto" {
+		method = ""
+		prefs := []string{"plain", "login", "cram-md5"}
+		if _, isTLS := c.TLSConnectionState(); !isTLS {
+			// don't send the password in the clear if it can be avoided
+			prefs = []string{"cram-md5", "plain", "login"}
+		}
+		for _, mech := range prefs {
+			if offered[mech] {
+				method = mech
+				break
+			}
+		}
+		if len(method) == 0 {
+			return nil, errors.New("server offers no supported AUTH mechanism: " + params)
+		}
+	} else if !offered[method] {
+		return nil, errors.New("server doesn't offer AUTH " + strings.ToUpper(method))
+	}
+	switch method {
+	case "plain":
+		return smtp.PlainAuth("", cfg["user"], cfg["pass"], cfg["host"]), nil
+	case "login":
+		return &loginAuth{username: cfg["user"], password: cfg["pass"], host: cfg["host"]}, nil
+	case "cram-md5":
+		return smtp.CRAMMD5Auth(cfg["user"], cfg["pass"]), nil
+	case "xoauth2":
+		token := cfg["token"]
+		if len(token) == 0 {
+			token = cfg["pass"]
+		}
+		return &xoauth2Auth{username: cfg["user"], token: token}, nil
+	}
+	return nil, errors.New("Unknown auth_method: " + cfg["auth_method"])
+}
@@ -0,0 +1,271 @@
+/*
+Batch sending for emailutils.
+
+Sending each message with SendEmail() means connecting to and
+authenticating with the server every time. A BatchSender sends a whole list
+of messages over a small pool of connections, each of which is reused for
+as many messages as possible, with several messages in flight at once:
+
+	batch, err := emailutils.NewBatchSender(emailCfg)
+	report := batch.Send(msgs)
+	for _, res := range report.Results {
+		if res.Err != nil { ... } // res.Index is the message's place in msgs
+	}
+
+The settings go in the config map with everything else:
+
+	batch_workers=4             connections used at the same time
+	batch_conn_messages=100     messages sent over a connection before it's
+	                            replaced - 0 means no limit
+
+A message rejected by the server doesn't cost the connection - it's reset
+and used for the next one. If a connection that has been idle turns out to
+have been dropped by the server, the message is tried once more on a new
+connection. The 'timeout' setting applies to each message, including any
+connecting, and 'check_mx=yes' works as it does for SendEmail().
+
+With a transport other than SMTP, messages are simply passed to it, still
+with the given number of workers.
+*/
+
+package emailutils
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	DefaultBatchWorkers = 4
+)
+
+// BatchSender sends lists of messages using a pool of SMTP connections.
+type BatchSender struct {
+	Config       map[string]string
+	Workers      int // number of connections used at the same time
+	ConnMessages int // messages per connection - 0 means no limit
+
+	transport Transport   // used for transports other than SMTP
+	signer    *DKIMSigner // nil unless DKIM is configured
+}
+
+// BatchResult is the outcome of sending one message in a batch.
+type BatchResult struct {
+	Index    int           // position of the message in the list
+	Err      error         // nil if the message was sent
+	Duration time.Duration // time taken, including any connecting
+}
+
+// BatchReport is the outcome of sending a batch.
+type BatchReport struct {
+	Results     []BatchResult // one for each message, in the same order
+	Sent        int           // messages sent successfully
+	Failed      int           // messages that couldn't be sent
+	Connections int           // SMTP connections made
+}
+
+// Err() returns nil if every message was sent, otherwise an error saying
+// how many failed, which wraps the first failure.
+func (r BatchReport) Err() error {
+	if r.Failed == 0 {
+		return nil
+	}
+	for _, res := range r.Results {
+		if res.Err != nil {
+			return fmt.Errorf("%d of %d message(s) failed - first was message %d: %w",
+				r.Failed, len(r.Results), res.Index, res.Err)
+		}
+	}
+	return nil
+}
+
+// NewBatchSender() creates a BatchSender from a config map.
+func NewBatchSender(cfg map[string]string) (*BatchSender, error) {
+	var errs = []string{}
+	b := &BatchSender{Config: cfg, Workers: DefaultBatchWorkers}
+	ints := map[string]*int{
+		"batch_workers":       &b.Workers,
+		"batch_conn_messages": &b.ConnMessages,
+	}
+	for key, dest := range ints {
+		if v := cfg[key]; len(v) > 0 {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 0 || (key == "batch_workers" && n == 0) {
+				errs = append(errs, "Invalid config value: "+key)
+			}
+			*dest = n
+		}
+	}
+	if len(errs) > 0 {
+		sort.Strings(errs)
+		return nil, fmt.Errorf("%w: %s", ErrConfig, strings.Join(errs[:], "; "))
+	}
+	t, err := NewTransport(cfg)
+	if err != nil {
+		return nil, err
+	}
+	if cfg["transport"] != "" && cfg["transport"] != "smtp" {
+		b.transport = t
+	} else if b.signer, err = NewDKIMSigner(cfg); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// SendBatch() sends a list of messages using a BatchSender.
+func SendBatch(cfg map[string]string, msgs []EmailMessage) (BatchReport, error) {
+	b, err := NewBatchSender(cfg)
+	if err != nil {
+		return BatchReport{}, err
+	}
+	report := b.Send(msgs)
+	return report, report.Err()
+}
+
+// Send() sends a list of messages.
+func (b *BatchSender) Send(msgs []EmailMessage) BatchReport {
+	return b.SendContext(context.Background(), msgs)
+}
+
+// SendContext() sends a list of messages, stopping if the context is
+// cancelled. Messages that weren't sent because of that have the context's
+// error as their result.
+func (b *BatchSender) SendContext(ctx context.Context, msgs []EmailMessage) BatchReport {
+	report := BatchReport{Results: make([]BatchResult, len(msgs))}
+	workers := b.Workers
+	if workers <= 0 {
+		workers = DefaultBatchWorkers
+	}
+	if workers > len(msgs) {
+		workers = len(msgs)
+	}
+	var conns int64
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			bw := &batchWorker{sender: b, conns: &conns}
+			defer bw.close()
+			for i := range jobs {
+				start := time.Now()
+				err := bw.send(ctx, msgs[i])
+				// each worker writes only its own results
+				report.Results[i] = BatchResult{Index: i, Err: err, Duration: time.Since(start)}
+			}
+		}()
+	}
+	for i := range msgs {
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+	for _, res := range report.Results {
+		if res.Err != nil {
+			report.Failed++
+		} else {
+			report.Sent++
+		}
+	}
+	report.Connections = int(conns)
+	return report
+}
+
+// batchWorker sends messages one at a time, keeping its SMTP session open
+// between them.
+type batchWorker struct {
+	sender  *BatchSender
+	conns   *int64
+	session *smtpSession
+	count   int // messages sent over the current session
+}
+
+// send() sends a single message, connecting first if necessary.
+func (bw *batchWorker) send(ctx context.Context, msg EmailMessage) error {
+	b := bw.sender
+	if err := msg.Header.CheckHeaders(); err != nil {
+		return err
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	d, err := configDuration(b.Config, "timeout")
+	if err != nil {
+		return err
+	}
+	msgCtx := ctx
+	if d > 0 {
+		var cancel context.CancelFunc
+		msgCtx, cancel = context.WithTimeout(ctx, d)
+		defer cancel()
+	}
+	if checkMX, _ := parseBool(b.Config["check_mx"]); checkMX {
+		if err := msg.Header.CheckMX(msgCtx, DefaultResolver); err != nil {
+			return err
+		}
+	}
+	if b.transport != nil {
+		return msg.SendViaContext(ctx, b.transport)
+	}
+	data := msg.Bytes()
+	if b.signer != nil {
+		signed, err := b.signer.Sign(data)
+		if err != nil {
+			return err
+		}
+		data = signed
+	}
+	for {
+		fresh := false
+		if bw.session == nil {
+			// the session outlives this message, so only connecting is
+			// limited by its timeout
+			s, err := dialSMTPSession(msgCtx, ctx, b.Config)
+			if err != nil {
+				return err
+			}
+			atomic.AddInt64(bw.conns, 1)
+			bw.session, bw.count, fresh = s, 0, true
+		}
+		err := bw.session.send(msgCtx, msg.Header.From, msg.Header.Recipients(), data)
+		var se *SendError
+		if err == nil || (errors.As(err, &se) && se.Delivered) {
+			bw.count++
+			if b.ConnMessages > 0 && bw.count >= b.ConnMessages {
+				bw.close()
+			} else if err != nil && bw.session.reset(msgCtx) != nil {
+				bw.close()
+			}
+			return err
+		}
+		if se != nil && se.Code > 0 {
+			// rejected, but the server is still talking to us
+			if bw.session.reset(msgCtx) != nil {
+				bw.close()
+			}
+			return err
+		}
+		bw.close()
+		// a reused connection may have been dropped while it was idle, in
+		// which case the message is worth one more try
+		if fresh || ctx.Err() != nil || se == nil || se.Stage != StageMail {
+			return err
+		}
+	}
+}
+
+// close() ends the worker's session, if it has one.
+func (bw *batchWorker) close() {
+	if bw.session != nil {
+		bw.session.close()
+		bw.session = nil
+	}
+}
@@ -0,0 +1,390 @@
+/*
+Typed configuration for emailutils.
+
+ReadConfigFile() returns a plain map and only checks that the essential keys
+are present. LoadConfig() reads the same file format into an EmailConfig and
+checks every value, reporting problems along with the line they're on -
+so a typo such as 'use_tls=ture' or 'port=58x' is caught early rather than
+causing a confusing failure when sending.
+
+The typed config understands these keys, in addition to those described in
+the package documentation:
+
+	tls_mode=starttls       none, starttls or implicit - overrides use_tls
+	dial_timeout=10s        time allowed to connect
+	command_timeout=30s     time allowed for each SMTP command
+	timeout=2m              time allowed for the whole session
+
+Passwords may be given indirectly, with pass_file, pass_env or pass_enc -
+see secrets.go. Boolean values may be yes/no, true/false, on/off or 1/0.
+Any keys that aren't recognised (eg, queue_* and throttle_* settings) are
+kept in Extra.
+*/
+
+package emailutils
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mspeculatrix/msgolib/fileutils"
+)
+
+const (
+	TLSNone     = "none"     // plain connection, never upgraded
+	TLSStartTLS = "starttls" // plain connection upgraded with STARTTLS if offered
+	TLSImplicit = "implicit" // TLS from the start, usually port 465
+)
+
+// EmailConfig holds validated email settings.
+type EmailConfig struct {
+	Host           string
+	Port           int
+	User           string
+	Pass           string
+	Token          string // OAuth2 bearer token for XOAUTH2
+	TLSMode        string // TLSNone, TLSStartTLS or TLSImplicit
+	TLSCAFile      string
+	TLSServerName  string
+	TLSInsecure    bool
+	AuthMethod     string // one of AuthMethods
+	DialTimeout    time.Duration
+	CommandTimeout time.Duration
+	Timeout        time.Duration
+	Transport      string // smtp, memory, maildir or spool
+	SpoolDir       string
+	DKIMDomain     string
+	DKIMSelector   string
+	DKIMKey        string
+	Extra          map[string]string // any other settings
+}
+
+// ConfigError describes a problem with a single config setting. Line is 0
+// if the setting didn't come from a file (or is missing altogether).
+type ConfigError struct {
+	Line int
+	Key  string
+	Msg  string
+}
+
+func (e ConfigError) Error() string {
+	if e.Line > 0 {
+		return "line " + strconv.Itoa(e.Line) + ": " + e.Key + ": " + e.Msg
+	}
+	return e.Key + ": " + e.Msg
+}
+
+// ConfigErrors is the list of problems found when validating a config.
+type ConfigErrors []ConfigError
+
+func (e ConfigErrors) Error() string {
+	msgs := make([]string, len(e))
+	for i, ce := range e {
+		msgs[i] = ce.Error()
+	}
+	return strings.Join(msgs, "; ")
+}
+
+// LoadConfig() reads an email config file and validates it.
+func LoadConfig(cfgFile string) (EmailConfig, error) {
+	entries, err := fileutils.ReadConfigEntries(cfgFile)
+	if err != nil {
+		return EmailConfig{}, err
+	}
+	cfg := map[string]string{}
+	for _, entry := range entries {
+		cfg[entry.Key] = entry.Value
+	}
+	errs := checkConfigPerms(cfgFile, cfg)
+	for i := range errs {
+		for _, entry := range entries {
+			if entry.Key == errs[i].Key {
+				errs[i].Line = entry.Line
+			}
+		}
+	}
+	entries, secretErrs := secretEntries(entries)
+	errs = append(errs, secretErrs...)
+	ec, err := parseConfig(entries)
+	if len(errs) > 0 {
+		if cerrs, ok := err.(ConfigErrors); ok {
+			errs = append(errs, cerrs...)
+		}
+		return ec, errs
+	}
+	return ec, err
+}
+
+// ConfigFromMap() validates a config map, such as one returned by
+// ReadConfigFile(), and converts it to an EmailConfig.
+func ConfigFromMap(cfg map[string]string) (EmailConfig, error) {
+	keys := make([]string, 0, len(cfg))
+	for k := range cfg {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	entries := make([]fileutils.ConfigEntry, len(keys))
+	for i, k := range keys {
+		entries[i] = fileutils.ConfigEntry{Key: k, Value: cfg[k]}
+	}
+	entries, errs := secretEntries(entries)
+	ec, err := parseConfig(entries)
+	if len(errs) > 0 {
+		if cerrs, ok := err.(ConfigErrors); ok {
+			errs = append(errs, cerrs...)
+		}
+		return ec, errs
+	}
+	return ec, err
+}
+
+// parseConfig() builds an EmailConfig from config entries, checking each
+// value as it goes.
+func parseConfig(entries []fileutils.ConfigEntry) (EmailConfig, error) {
+	var errs ConfigErrors
+	cfg := EmailConfig{Extra: map[string]string{}}
+	useTLS := ""
+	portSet := false
+	bad := func(entry fileutils.ConfigEntry, msg string) {
+		errs = append(errs, ConfigError{Line: entry.Line, Key: entry.Key, Msg: msg})
+	}
+	for _, entry := range entries {
+		v := entry.Value
+		switch entry.Key {
+		case "host":
+			cfg.Host = v
+		case "port":
+			port, err := strconv.Atoi(v)
+			if err != nil || port < 1 || port > 65535 {
+				bad(entry, "invalid port number '"+v+"'")
+			}
+			cfg.Port = port
+			portSet = true
+		case "user":
+			cfg.User = v
+		case "pass":
+			cfg.Pass = v
+		case "token":
+			cfg.Token = v
+		case "use_tls":
+			if _, err := parseBool(v); err != nil {
+				bad(entry, err.Error())
+			}
+			useTLS = v
+		case "tls_mode":
+			v = strings.ToLower(v)
+			if v != TLSNone && v != TLSStartTLS && v != TLSImplicit {
+				bad(entry, "must be none, starttls or implicit, not '"+entry.Value+"'")
+			}
+			cfg.TLSMode = v
+		case "tls_ca_file":
+			cfg.TLSCAFile = v
+		case "tls_server_name":
+			cfg.TLSServerName = v
+		case "tls_insecure":
+			b, err := parseBool(v)
+			if err != nil {
+				bad(entry, err.Error())
+			}
+			cfg.TLSInsecure = b
+		case "auth_method":
+			v = strings.ToLower(v)
+			if !validAuthMethod(v) {
+				bad(entry, "must be one of "+strings.Join(AuthMethods, ", ")+
+					", not '"+entry.Value+"'")
+			}
+			cfg.AuthMethod = v
+		case "dial_timeout", "command_timeout", "timeout":
+			d, err := time.ParseDuration(v)
+			if err != nil || d < 0 {
+				bad(entry, "invalid duration '"+v+"' - use a form such as 30s or 2m")
+			}
+			switch entry.Key {
+			case "dial_timeout":
+				cfg.DialTimeout = d
+			case "command_timeout":
+				cfg.CommandTimeout = d
+			default:
+				cfg.Timeout = d
+			}
+		case "transport":
+			v = strings.ToLower(v)
+			if v != "smtp" && v != "memory" && v != "maildir" && v != "spool" {
+				bad(entry, "must be smtp, memory, maildir or spool, not '"+entry.Value+"'")
+			}
+			cfg.Transport = v
+		case "spool_dir":
+			cfg.SpoolDir = v
+		case "dkim_domain":
+			cfg.DKIMDomain = v
+		case "dkim_selector":
+			cfg.DKIMSelector = v
+		case "dkim_key":
+			cfg.DKIMKey = v
+		default:
+			cfg.Extra[entry.Key] = v
+		}
+	}
+	// tls_mode takes precedence over the older use_tls
+	if len(cfg.TLSMode) == 0 {
+		cfg.TLSMode = TLSStartTLS
+		if b, _ := parseBool(useTLS); b {
+			cfg.TLSMode = TLSImplicit
+		}
+	}
+	if !portSet {
+		cfg.Port = 587
+		if cfg.TLSMode == TLSImplicit {
+			cfg.Port = 465
+		}
+	}
+	if len(cfg.AuthMethod) == 0 {
+		cfg.AuthMethod = "auto"
+	}
+	if len(cfg.Transport) == 0 {
+		cfg.Transport = "smtp"
+	}
+	errs = append(errs, cfg.missing()...)
+	if len(errs) > 0 {
+		return cfg, errs
+	}
+	return cfg, nil
+}
+
+// Validate() checks that the settings make sense together. This is useful
+// when an EmailConfig has been put together in code rather than loaded. Empty
+// values for Port, TLSMode and AuthMethod mean the defaults.
+func (cfg EmailConfig) Validate() error {
+	var errs ConfigErrors
+	if cfg.Port < 0 || cfg.Port > 65535 {
+		errs = append(errs, ConfigError{Key: "port", Msg: "invalid port number"})
+	}
+	if len(cfg.TLSMode) > 0 && cfg.TLSMode != TLSNone && cfg.TLSMode != TLSStartTLS &&
+		cfg.TLSMode != TLSImplicit {
+		errs = append(errs, ConfigError{Key: "tls_mode", Msg: "must be none, starttls or implicit"})
+	}
+	if len(cfg.AuthMethod) > 0 && !validAuthMethod(cfg.AuthMethod) {
+		errs = append(errs, ConfigError{Key: "auth_method", Msg: "unknown method"})
+	}
+	errs = append(errs, cfg.missing()...)
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// missing() looks for required settings that haven't been given.
+func (cfg EmailConfig) missing() ConfigErrors {
+	var errs ConfigErrors
+	missing := func(key string) {
+		errs = append(errs, ConfigError{Key: key, Msg: "missing config value"})
+	}
+	switch cfg.Transport {
+	case "", "smtp":
+		if len(cfg.Host) == 0 {
+			missing("host")
+		}
+		if cfg.AuthMethod != "none" {
+			if len(cfg.User) == 0 {
+				missing("user")
+			}
+			if len(cfg.Pass) == 0 && len(cfg.Token) == 0 {
+				missing("pass")
+			}
+		}
+	case "maildir", "spool":
+		if len(cfg.SpoolDir) == 0 {
+			missing("spool_dir")
+		}
+	}
+	dkim := []string{cfg.DKIMDomain, cfg.DKIMSelector, cfg.DKIMKey}
+	if len(strings.Join(dkim, "")) > 0 {
+		for i, key := range []string{"dkim_domain", "dkim_selector", "dkim_key"} {
+			if len(dkim[i]) == 0 {
+				missing(key)
+			}
+		}
+	}
+	return errs
+}
+
+// Map() converts the config back into the map form used by SendEmail() and
+// the rest of the package.
+func (cfg EmailConfig) Map() map[string]string {
+	m := map[string]string{}
+	for k, v := range cfg.Extra {
+		m[k] = v
+	}
+	set := func(key string, value string) {
+		if len(value) > 0 {
+			m[key] = value
+		}
+	}
+	set("host", cfg.Host)
+	m["port"] = strconv.Itoa(cfg.Port)
+	if cfg.Port == 0 {
+		m["port"] = "587"
+		if cfg.TLSMode == TLSImplicit {
+			m["port"] = "465"
+		}
+	}
+	set("user", cfg.User)
+	set("pass", cfg.Pass)
+	set("token", cfg.Token)
+	m["use_tls"] = "no"
+	if cfg.TLSMode == TLSImplicit {
+		m["use_tls"] = "yes"
+	}
+	set("tls_mode", cfg.TLSMode)
+	set("tls_ca_file", cfg.TLSCAFile)
+	set("tls_server_name", cfg.TLSServerName)
+	if cfg.TLSInsecure {
+		m["tls_insecure"] = "yes"
+	}
+	set("auth_method", cfg.AuthMethod)
+	durations := map[string]time.Duration{
+		"dial_timeout":    cfg.DialTimeout,
+		"command_timeout": cfg.CommandTimeout,
+		"timeout":         cfg.Timeout,
+	}
+	for key, d := range durations {
+		if d > 0 {
+			m[key] = d.String()
+		}
+	}
+	set("transport", cfg.Transport)
+	set("spool_dir", cfg.SpoolDir)
+	set("dkim_domain", cfg.DKIMDomain)
+	set("dkim_selector", cfg.DKIMSelector)
+	set("dkim_key", cfg.DKIMKey)
+	return m
+}
+
+// SendWithConfig() is the counterpart of SendEmail() for a typed config.
+func (msg EmailMessage) SendWithConfig(cfg EmailConfig) error {
+	return msg.SendWithConfigContext(context.Background(), cfg)
+}
+
+// SendWithConfigContext() is the counterpart of SendContext() for a typed
+// config.
+func (msg EmailMessage) SendWithConfigContext(ctx context.Context, cfg EmailConfig) error {
+	if err := cfg.Validate(); err != nil {
+		return err
+	}
+	return msg.SendContext(ctx, cfg.Map())
+}
+
+// parseBool() interprets the various ways of saying yes or no.
+func parseBool(value string) (bool, error) {
+	switch strings.ToLower(value) {
+	case "yes", "true", "on", "1":
+		return true, nil
+	case "no", "false", "off", "0", "":
+		return false, nil
+	}
+	return false, errors.New("must be yes or no, not '" + value + "'")
+}
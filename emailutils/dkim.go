@@ -0,0 +1,273 @@
+/*
+DKIM signing for emailutils.
+
+If the config map contains DKIM settings, every message is signed just
+before it is handed to the transport:
+
+	dkim_domain=example.com                  the signing domain (d=)
+	dkim_selector=iot                        the selector (s=)
+	dkim_key=/etc/email/dkim_private.pem     PEM-encoded private key
+
+The key can be RSA (PKCS#1 or PKCS#8), giving rsa-sha256 signatures, or
+Ed25519 (PKCS#8), giving ed25519-sha256 signatures as per RFC 8463. The
+matching public key must be published in DNS at
+<selector>._domainkey.<domain>.
+
+Headers and body are both canonicalised with the 'relaxed' algorithm.
+*/
+
+package emailutils
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DKIMHeaders is the default list of headers included in the signature, if
+// they're present in the message.
+var DKIMHeaders = []string{
+	"From", "Reply-To", "To", "Cc", "Subject", "Date", "Message-ID",
+	"MIME-Version", "Content-Type", "Content-Transfer-Encoding",
+}
+
+// DKIMSigner adds DKIM-Signature headers to rendered messages.
+type DKIMSigner struct {
+	Domain   string        // signing domain
+	Selector string        // selector for the public key record in DNS
+	Key      crypto.Signer // *rsa.PrivateKey or ed25519.PrivateKey
+	Headers  []string      // headers to sign - DKIMHeaders if nil
+}
+
+// NewDKIMSigner() creates a signer from the dkim_* keys in a config map. If
+// there are no DKIM settings in the map, it returns nil and no error.
+func NewDKIMSigner(cfg map[string]string) (*DKIMSigner, error) {
+	if len(cfg["dkim_domain"]) == 0 && len(cfg["dkim_selector"]) == 0 &&
+		len(cfg["dkim_key"]) == 0 {
+		return nil, nil
+	}
+	var errs = []string{}
+	for _, key := range []string{"dkim_domain", "dkim_selector", "dkim_key"} {
+		if len(cfg[key]) == 0 {
+			errs = append(errs, "Missing config value: "+key)
+		}
+	}
+	if len(errs) > 0 {
+		return nil, fmt.Errorf("%w: %s", ErrConfig, strings.Join(errs[:], "; "))
+	}
+	return LoadDKIMSigner(cfg["dkim_domain"], cfg["dkim_selector"], cfg["dkim_key"])
+}
+
+// LoadDKIMSigner() creates a signer using a private key read from a PEM file.
+func LoadDKIMSigner(domain string, selector string, keyFile string) (*DKIMSigner, error) {
+	data, err := os.ReadFile(keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading DKIM key: %v", err)
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("No PEM data found in DKIM key file " + keyFile)
+	}
+	var key interface{}
+	if block.Type == "RSA PRIVATE KEY" {
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	} else {
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Error parsing DKIM key: %v", err)
+	}
+	signer := &DKIMSigner{Domain: domain, Selector: selector}
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		signer.Key = k
+	case ed25519.PrivateKey:
+		signer.Key = k
+	default:
+		return nil, errors.New("Unsupported DKIM key type - must be RSA or Ed25519")
+	}
+	return signer, nil
+}
+
+// Sign() returns a copy of the message with a DKIM-Signature header added
+// at the top.
+func (s *DKIMSigner) Sign(msg []byte) ([]byte, error) {
+	var algo string
+	switch s.Key.(type) {
+	case *rsa.PrivateKey:
+		algo = "rsa-sha256"
+	case ed25519.PrivateKey:
+		algo = "ed25519-sha256"
+	default:
+		return nil, errors.New("Unsupported DKIM key type - must be RSA or Ed25519")
+	}
+	header, body := splitMessage(msg)
+	bodyHash := sha256.Sum256(dkimCanonBody(body))
+
+	// pick out the headers to be signed, in the order listed
+	names := s.Headers
+	if names == nil {
+		names = DKIMHeaders
+	}
+	fields := splitHeaderFields(header)
+	signed := []string{}
+	var data bytes.Buffer
+	for _, name := range names {
+		if field, ok := lastHeaderField(fields, name); ok {
+			signed = append(signed, strings.ToLower(name))
+			data.WriteString(dkimCanonHeader(field) + "\r\n")
+		}
+	}
+	if !contains(signed, "from") {
+		return nil, errors.New("Message has no From header to sign")
+	}
+
+	value := "v=1; a=" + algo + "; c=relaxed/relaxed; d=" + s.Domain +
+		"; s=" + s.Selector + "; t=" + strconv.FormatInt(time.Now().Unix(), 10) +
+		"; h=" + strings.Join(signed, ":") +
+		"; bh=" + base64.StdEncoding.EncodeToString(bodyHash[:]) + "; b="
+	// the signature header itself is signed, with an empty b= tag and
+	// without a trailing CRLF
+	data.WriteString(dkimCanonHeader("DKIM-Signature: " + value))
+	hash := sha256.Sum256(data.Bytes())
+
+	var sig []byte
+	var err error
+	if key, ok := s.Key.(ed25519.PrivateKey); ok {
+		sig = ed25519.Sign(key, hash[:])
+	} else {
+		sig, err = s.Key.Sign(rand.Reader, hash[:], crypto.SHA256)
+		if err != nil {
+			return nil, fmt.Errorf("Error signing message: %v", err)
+		}
+	}
+	b64 := base64.StdEncoding.EncodeToString(sig)
+	// break up the signature so the header can be folded
+	chunks := []string{}
+	for len(b64) > 64 {
+		chunks = append(chunks, b64[:64])
+		b64 = b64[64:]
+	}
+	chunks = append(chunks, b64)
+
+	var out bytes.Buffer
+	out.WriteString(foldHeader("DKIM-Signature", value+strings.Join(chunks, " ")))
+	out.Write(msg)
+	return out.Bytes(), nil
+}
+
+// dkimTransport signs messages before passing them on to another Transport.
+type dkimTransport struct {
+	signer    *DKIMSigner
+	transport Transport
+}
+
+// Send() signs the message and sends it.
+func (t *dkimTransport) Send(from string, to []string, msg []byte) error {
+	return t.SendContext(context.Background(), from, to, msg)
+}
+
+// SendContext() signs the message and sends it, passing the context on if
+// the underlying transport accepts one.
+func (t *dkimTransport) SendContext(ctx context.Context, from string, to []string, msg []byte) error {
+	signed, err := t.signer.Sign(msg)
+	if err != nil {
+		return err
+	}
+	if ct, ok := t.transport.(ContextTransport); ok {
+		return ct.SendContext(ctx, from, to, signed)
+	}
+	return t.transport.Send(from, to, signed)
+}
+
+// splitMessage() separates the header block from the body. The header block
+// keeps its final CRLF.
+func splitMessage(msg []byte) ([]byte, []byte) {
+	idx := bytes.Index(msg, []byte("\r\n\r\n"))
+	if idx < 0 {
+		return msg, nil
+	}
+	return msg[:idx+2], msg[idx+4:]
+}
+
+// splitHeaderFields() breaks a header block into individual fields, each
+// including any continuation lines but not the final CRLF.
+func splitHeaderFields(header []byte) []string {
+	fields := []string{}
+	for _, line := range strings.Split(string(header), "\r\n") {
+		if len(line) == 0 {
+			continue
+		}
+		if (line[0] == ' ' || line[0] == '\t') && len(fields) > 0 {
+			fields[len(fields)-1] += "\r\n" + line
+		} else {
+			fields = append(fields, line)
+		}
+	}
+	return fields
+}
+
+// lastHeaderField() finds the last field with the given name.
+func lastHeaderField(fields []string, name string) (string, bool) {
+	for i := len(fields) - 1; i >= 0; i-- {
+		colon := strings.Index(fields[i], ":")
+		if colon > 0 && strings.EqualFold(strings.TrimSpace(fields[i][:colon]), name) {
+			return fields[i], true
+		}
+	}
+	return "", false
+}
+
+// dkimCanonHeader() applies 'relaxed' header canonicalisation (RFC 6376
+// 3.4.2) to a single field.
+func dkimCanonHeader(field string) string {
+	colon := strings.Index(field, ":")
+	name := strings.ToLower(strings.TrimSpace(field[:colon]))
+	value := strings.ReplaceAll(field[colon+1:], "\r\n", "")
+	return name + ":" + strings.Join(strings.Fields(value), " ")
+}
+
+// dkimCanonBody() applies 'relaxed' body canonicalisation (RFC 6376 3.4.4).
+func dkimCanonBody(body []byte) []byte {
+	lines := strings.Split(string(body), "\r\n")
+	for i, line := range lines {
+		line = strings.TrimRight(line, " \t")
+		lines[i] = strings.Join(strings.FieldsFunc(line, func(r rune) bool {
+			return r == ' ' || r == '\t'
+		}), " ")
+		if len(line) > 0 && (line[0] == ' ' || line[0] == '\t') {
+			lines[i] = " " + lines[i]
+		}
+	}
+	// remove empty lines at the end of the body
+	for len(lines) > 0 && len(lines[len(lines)-1]) == 0 {
+		lines = lines[:len(lines)-1]
+	}
+	if len(lines) == 0 {
+		return nil
+	}
+	return []byte(strings.Join(lines, "\r\n") + "\r\n")
+}
+
+// contains() checks whether a list of strings includes a given string.
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
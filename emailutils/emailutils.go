@@ -16,11 +16,33 @@ pass=top_secret_password
 use_tls=no
 
 If 'port' is excluded, the code will select 465 or 587 depending on the value of
-'use_tls' (if 'yes', uses 465, any other value will cause 587 to be selected).
+'use_tls' (if 'yes', uses 465, if 'no', 587 - true/false, on/off and 1/0
+work too, and any other value is an error).
 If 'use_tls' is ommitted, it will default to 'no'.
 
+Rather than keeping the password in the config file, it can be read from
+another file, an environment variable or decrypted with a local key - see
+secrets.go. A config file holding a plain-text password must not be
+world-readable.
+
+The SMTP authentication mechanism can be chosen with 'auth_method' - see
+auth.go. With 'auth_method=none', 'user' and 'pass' aren't needed.
+
+Messages can be DKIM-signed by adding 'dkim_domain', 'dkim_selector' and
+'dkim_key' - see dkim.go.
+
+Instead of SMTP, messages can be written to a maildir or kept in memory for
+testing - see the 'transport' key in transport.go.
+
+Server certificates are always verified. To trust a private CA, add
+'tls_ca_file=/path/to/ca.pem'. To skip verification altogether (not
+recommended), add 'tls_insecure=yes'.
+
 The standard location for a config file is: /etc/email/email_default.cfg
 
+Several configs can be kept as named profiles, with backup relays tried when
+the main one fails - see profiles.go.
+
 But these details can also be put manually in a map[string]string where the keys
 are: host, port, user, pass and use_tls
 
@@ -29,6 +51,9 @@ To use this library:
 Create the config map manually or by reading the details from a file with:
 	emailConfig := ReadConfigFile(<filepath>)
 
+Or, for a config that's checked more thoroughly, use LoadConfig() and send
+with SendWithConfig() - see config.go.
+
 Create an EmailMessage object - eg,
 
 var email emailutils.EmailMessage
@@ -40,6 +65,14 @@ Set the headers:
 	email.SetSender("sender@example.com")
 	email.SetSenderName("Mr A Sender")
 	email.SetSubject("A message just for you")
+	// Optional copies and reply address. Bcc addresses receive the message
+	// but don't appear in the headers.
+	email.AddCc("ops@example.com")
+	email.AddBcc("audit@example.com")
+	email.AddReplyTo("team@example.com")
+
+AddRecipient(), SetSender() and the other address functions return an error,
+without changing the message, if the address isn't valid - see address.go.
 
 The email.Header.From setting could use the 'user' entry from the config.
 In the example above, this would be emailConfig["user"].
@@ -50,6 +83,15 @@ Build the email body:
 	email.BodyAppend("Some text")
 	email.BodyAppend("Some more text")
 
+Alternatively, the subject and body can be built from template files - see
+template.go.
+
+Optionally, add an HTML version of the body and/or attachments:
+
+	email.HTMLSet("<h1>IoT Alert</h1><p>Some text</p>")
+	email.AttachFile("/var/log/sensor.log")
+	email.AddAttachment("reading.csv", "text/csv", csvData)
+
 Add a signature if you want.
 
 	email.AddSignature("My sig")
@@ -58,17 +100,24 @@ Send the email:
 
 	email.SendEmail(emailCfg)
 
+To send many messages at once, reusing connections to the server, use a
+BatchSender - see batch.go.
+
+Incoming messages can be collected from an IMAP or POP3 mailbox with
+FetchMessages() or a MailPoller - see fetch.go and parse.go.
+
+For testing, TestServer provides a local SMTP server - see testserver.go.
+
 */
 
 package emailutils
 
 import (
-	"crypto/tls"
-	"errors"
+	"context"
 	"fmt"
 	"log"
-	"net/smtp"
 	"strings"
+	"time"
 
 	"github.com/mspeculatrix/msgolib/fileutils"
 )
@@ -77,30 +126,63 @@ var (
 	ConfigKeys = []string{"host", "port", "user", "pass", "use_tls"}
 )
 
-// type EmailError struct {
-// 	msg string
-// 	err error
-// }
-
-// func (e *EmailError) Error() string {
-// 	return e.msg + e.err.Error()
-// }
-
 type EmailHeader struct {
 	Name    string   // sender's name
 	From    string   // sender's email address
 	To      []string // recipients' email addresses
+	Cc      []string // copied recipients' email addresses
+	Bcc     []string // blind-copied addresses - never appear in the headers
+	ReplyTo []string // addresses replies should go to, if not the sender
 	Subject string   // message subject line
+	// Optional. If left empty, these are generated when the headers are
+	// rendered.
+	Date      time.Time // date the message was composed
+	MessageID string    // unique ID, in the form <id@domain>
 }
 
 type EmailMessage struct {
-	Header EmailHeader
-	Body   string
+	Header      EmailHeader
+	Body        string       // plain-text body
+	HTMLBody    string       // optional HTML alternative to Body
+	Attachments []Attachment // optional files sent with the message
 }
 
-// AddRecipient() adds an email address to the EmailHeader.To list
-func (e *EmailMessage) AddRecipient(addr string) {
+// AddRecipient() adds an email address to the EmailHeader.To list. The
+// address is checked first and isn't added if it's invalid - see address.go.
+func (e *EmailMessage) AddRecipient(addr string) error {
+	if err := checkAddress("To", addr); err != nil {
+		return err
+	}
 	e.Header.To = append(e.Header.To, addr)
+	return nil
+}
+
+// AddCc() adds an email address to the EmailHeader.Cc list
+func (e *EmailMessage) AddCc(addr string) error {
+	if err := checkAddress("Cc", addr); err != nil {
+		return err
+	}
+	e.Header.Cc = append(e.Header.Cc, addr)
+	return nil
+}
+
+// AddBcc() adds an email address to the EmailHeader.Bcc list. These
+// addresses receive the message but are not included in the headers.
+func (e *EmailMessage) AddBcc(addr string) error {
+	if err := checkAddress("Bcc", addr); err != nil {
+		return err
+	}
+	e.Header.Bcc = append(e.Header.Bcc, addr)
+	return nil
+}
+
+// AddReplyTo() adds an email address to the EmailHeader.ReplyTo list
+func (e *EmailMessage) AddReplyTo(addr string) error {
+	if err := checkAddress("Reply-To", addr); err != nil {
+		return err
+	}
+	e.Header.ReplyTo = append(e.Header.ReplyTo, addr)
+	return nil
 }
 
 // AddSignature() simply adds a given string to the end of the message.
@@ -121,40 +203,79 @@ func (e *EmailMessage) BodyAppend(text string) {
 	e.Body += text + "\r\n"
 }
 
-// CheckHeaders() checks to see if the essential headers have values
+// CheckHeaders() checks to see if the essential headers have values and
+// that all the addresses are valid. Any problems are returned as
+// HeaderErrors, one for each field or address at fault.
 func (hdr EmailHeader) CheckHeaders() error {
-	errs := make([]string, 0)
+	var errs HeaderErrors
 	if hdr.From == "" {
-		errs = append(errs, "Header from field empty")
+		errs = append(errs, HeaderError{Field: "From", Msg: "field empty"})
+	} else if err := checkAddress("From", hdr.From); err != nil {
+		errs = append(errs, err.(HeaderError))
 	}
 	if len(hdr.To) == 0 {
-		errs = append(errs, "Header to field empty")
+		errs = append(errs, HeaderError{Field: "To", Msg: "field empty"})
+	}
+	fields := []struct {
+		name  string
+		addrs []string
+	}{{"To", hdr.To}, {"Cc", hdr.Cc}, {"Bcc", hdr.Bcc}, {"Reply-To", hdr.ReplyTo}}
+	for _, field := range fields {
+		for _, addr := range field.addrs {
+			if err := checkAddress(field.name, addr); err != nil {
+				errs = append(errs, err.(HeaderError))
+			}
+		}
 	}
 	if hdr.Subject == "" {
-		errs = append(errs, "Header subject empty")
+		errs = append(errs, HeaderError{Field: "Subject", Msg: "field empty"})
 	}
 	if len(errs) > 0 {
-		return errors.New(strings.Join(errs[:], "; "))
+		return errs
 	}
 	return nil
 }
 
-// HeaderString() creates a single string from the headers.
+// Recipients() returns every address the message is to be delivered to -
+// To, Cc and Bcc - for use in the SMTP envelope.
+func (hdr EmailHeader) Recipients() []string {
+	rcpts := make([]string, 0, len(hdr.To)+len(hdr.Cc)+len(hdr.Bcc))
+	rcpts = append(rcpts, hdr.To...)
+	rcpts = append(rcpts, hdr.Cc...)
+	rcpts = append(rcpts, hdr.Bcc...)
+	return rcpts
+}
+
+// HeaderString() creates a single string from the headers, ending with the
+// blank line that separates them from the body. Date and Message-ID are
+// generated if they haven't been set.
 func (e EmailMessage) HeaderString() string {
 	hdrStr := ""
-	fromStr := ""
 	err := e.Header.CheckHeaders()
 	if err != nil {
 		log.Println(err)
 	} else {
-		if len(e.Header.Name) == 0 {
-			fromStr = e.Header.From
-		} else {
-			fromStr = e.Header.Name + " <" + e.Header.From + ">"
+		date := e.Header.Date
+		if date.IsZero() {
+			date = time.Now()
+		}
+		msgID := e.Header.MessageID
+		if len(msgID) == 0 {
+			msgID = newMessageID(e.Header.From)
+		}
+		hdrStr = foldHeader("Date", date.Format(time.RFC1123Z))
+		hdrStr += foldHeader("Message-ID", msgID)
+		hdrStr += foldHeader("From", formatAddress(e.Header.Name, e.Header.From))
+		if len(e.Header.ReplyTo) > 0 {
+			hdrStr += foldHeader("Reply-To", formatAddressList(e.Header.ReplyTo))
 		}
-		hdrStr = "From: " + fromStr + "\r\n"
-		hdrStr += "To: " + strings.Join(e.Header.To, ",") + "\r\n"
-		hdrStr += "Subject: " + e.Header.Subject + "\r\n\r\n"
+		hdrStr += foldHeader("To", formatAddressList(e.Header.To))
+		if len(e.Header.Cc) > 0 {
+			hdrStr += foldHeader("Cc", formatAddressList(e.Header.Cc))
+		}
+		hdrStr += foldHeader("Subject", encodeHeaderText(e.Header.Subject))
+		hdrStr += e.mimeHeaders()
+		hdrStr += "\r\n"
 	}
 	return hdrStr
 }
@@ -169,15 +290,53 @@ func ReadConfigFile(cfgFile string) (map[string]string, error) {
 	if err != nil {
 		errs = append(errs, "Error reading email config file")
 	}
-	// make sure all the important keys are present and had some value in the
-	// config file
-	for _, v := range ConfigKeys {
+	// passwords may be kept elsewhere - see secrets.go
+	secretErrs := append(checkConfigPerms(cfgFile, emailCfg), resolveSecrets(emailCfg)...)
+	for _, ce := range secretErrs {
+		errs = append(errs, ce.Error())
+	}
+	errs = append(errs, checkConfigMap(emailCfg)...)
+	if len(errs) > 0 {
+		err = fmt.Errorf("%w: %s", ErrConfig, strings.Join(errs[:], "; "))
+	}
+	return emailCfg, err
+}
+
+// checkConfigMap() makes sure all the important keys are present and have
+// some value in a config map, filling in defaults for port and use_tls.
+// It returns a list of the problems found.
+func checkConfigMap(emailCfg map[string]string) []string {
+	var errs = []string{}
+	// Only SMTP needs a server to talk to.
+	requiredKeys := ConfigKeys
+	if len(emailCfg["transport"]) > 0 && emailCfg["transport"] != "smtp" {
+		requiredKeys = nil
+	}
+	if len(emailCfg["auth_method"]) > 0 &&
+		!validAuthMethod(strings.ToLower(emailCfg["auth_method"])) {
+		errs = append(errs, "Invalid config value: auth_method")
+	}
+	if _, err := parseBool(emailCfg["use_tls"]); err != nil {
+		errs = append(errs, "Invalid config value: use_tls")
+	}
+	for _, key := range []string{"dial_timeout", "command_timeout", "timeout"} {
+		if _, err := configDuration(emailCfg, key); err != nil {
+			errs = append(errs, "Invalid config value: "+key)
+		}
+	}
+	for _, v := range requiredKeys {
+		if (v == "user" || v == "pass") && strings.ToLower(emailCfg["auth_method"]) == "none" {
+			continue // no credentials needed
+		}
+		if v == "pass" && len(emailCfg["token"]) > 0 {
+			continue // xoauth2 token used instead
+		}
 		if len(emailCfg[v]) == 0 {
 			switch v {
 			case "port":
 				// no port was provided, so we'll go with default values
 				emailCfg["port"] = "587"
-				if emailCfg["use_tls"] == "yes" {
+				if smtpTLSMode(emailCfg) == TLSImplicit {
 					emailCfg["port"] = "465"
 				}
 			case "use_tls":
@@ -187,81 +346,39 @@ func ReadConfigFile(cfgFile string) (map[string]string, error) {
 			}
 		}
 	}
-	if len(errs) > 0 {
-		err = errors.New(strings.Join(errs[:], "; "))
-	}
-	return emailCfg, err
+	return errs
 }
 
-// SendEmail() does what it says on the tin
+// SendEmail() does what it says on the tin. The message is handed to the
+// Transport selected by the config map - normally SMTP, in which case the
+// whole message is sent in a single session, whichever TLS mode is in use.
 func (msg EmailMessage) SendEmail(cfg map[string]string) error {
-	//var errors = []string{}
-	var e_err error
-	email := msg.HeaderString()
-	email += msg.Body + "\r\n"
-	err := msg.Header.CheckHeaders()
+	return msg.SendContext(context.Background(), cfg)
+}
+
+// SendContext() works like SendEmail(), but sending is abandoned if the
+// context is cancelled or its deadline passes. SMTP failures are returned
+// as a *SendError saying which stage of the session failed.
+func (msg EmailMessage) SendContext(ctx context.Context, cfg map[string]string) error {
+	t, err := NewTransport(cfg)
 	if err != nil {
-		e_err = fmt.Errorf("Error in email headers " + err.Error())
-	} else {
-		auth := smtp.PlainAuth("", cfg["user"], cfg["pass"], cfg["host"])
-		if cfg["use_tls"] == "yes" {
-			// Create a TLS connection.
-			tlsConfig := &tls.Config{
-				InsecureSkipVerify: true,
-				ServerName:         cfg["host"],
-			}
-			for _, mailto := range msg.Header.To {
-				fmt.Println(mailto)
-				conn, err := tls.Dial("tcp", cfg["host"]+":"+cfg["port"], tlsConfig)
-				if err != nil {
-					e_err = fmt.Errorf("Failure to make TCP connection " + err.Error())
-				} else {
-					c, err := smtp.NewClient(conn, cfg["host"])
-					if err != nil {
-						e_err = fmt.Errorf("Error creating client " + err.Error())
-					} else {
-						if err = c.Auth(auth); err != nil {
-							e_err = fmt.Errorf("Error authenticating " + err.Error())
-						} else {
-							if err = c.Mail(msg.Header.From); err != nil {
-								e_err = fmt.Errorf("Error setting From address " + err.Error())
-							} else {
-								if err = c.Rcpt(mailto); err != nil {
-									e_err = fmt.Errorf("Error setting To address " + err.Error())
-								} else {
-									w, err := c.Data()
-									if err != nil {
-										e_err = fmt.Errorf("Error creating data object " + err.Error())
-									} else {
-										_, err = w.Write([]byte(msg.Body))
-										if err != nil {
-											e_err = fmt.Errorf("Error writing message " + err.Error())
-										}
-										w.Close()
-									}
-								}
-							}
-						}
-					}
-					c.Quit()
-				}
-			}
-		} else {
-			// Use the normal SendMail() method. This will employ TLS via starttls
-			// if possible. It's probably fine for most uses.
-			err = smtp.SendMail(cfg["host"]+":"+cfg["port"], auth, msg.Header.From,
-				msg.Header.To, []byte(email))
-			if err != nil {
-				e_err = fmt.Errorf("Error sending email " + err.Error())
-			}
+		return err
+	}
+	if checkMX, _ := parseBool(cfg["check_mx"]); checkMX {
+		if err = msg.Header.CheckMX(ctx, DefaultResolver); err != nil {
+			return err
 		}
 	}
-	return e_err
+	return msg.SendViaContext(ctx, t)
 }
 
-// SetSender() sets email address of sender
-func (e *EmailMessage) SetSender(sender string) {
+// SetSender() sets email address of sender, if it's valid
+func (e *EmailMessage) SetSender(sender string) error {
+	if err := checkAddress("From", sender); err != nil {
+		return err
+	}
 	e.Header.From = sender
+	return nil
 }
 
 // SetSenderName() sets the name string of the sender
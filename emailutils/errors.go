@@ -0,0 +1,188 @@
+/*
+Errors for emailutils.
+
+Failures can be examined with errors.Is() and errors.As(). The sentinel
+errors say what kind of thing went wrong:
+
+	if errors.Is(err, emailutils.ErrAuth) {
+		// bad credentials - no point retrying
+	}
+
+SMTP failures are returned as a *SendError, which carries the server's
+reply code (if there was one) and, for rejected recipients, a list of
+RecipientErrors. IsTemporary() reports whether it's worth trying again.
+*/
+
+package emailutils
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/textproto"
+	"strconv"
+	"strings"
+)
+
+var (
+	ErrHeaders    = errors.New("Error in email headers")
+	ErrConfig     = errors.New("Error in email config")
+	ErrConnection = errors.New("Error connecting to mail server")
+	ErrAuth       = errors.New("Error authenticating with mail server")
+	ErrSender     = errors.New("Sender address rejected")
+	ErrRecipient  = errors.New("Recipient address rejected")
+	ErrData       = errors.New("Message rejected")
+)
+
+// stageErrors maps each SMTP stage to the sentinel error it matches.
+var stageErrors = map[Stage]error{
+	StageDial: ErrConnection,
+	StageAuth: ErrAuth,
+	StageMail: ErrSender,
+	StageRcpt: ErrRecipient,
+	StageData: ErrData,
+}
+
+// RecipientError describes the rejection of a single recipient.
+type RecipientError struct {
+	Address string
+	Code    int // SMTP reply code, eg 550
+	Err     error
+}
+
+func (e *RecipientError) Error() string {
+	return e.Address + ": " + e.Err.Error()
+}
+
+func (e *RecipientError) Unwrap() error {
+	return e.Err
+}
+
+// Temporary() reports whether the rejection might succeed if tried later.
+func (e *RecipientError) Temporary() bool {
+	return e.Code >= 400 && e.Code < 500
+}
+
+// Is() makes errors.Is(err, ErrRecipient) true for any RecipientError.
+func (e *RecipientError) Is(target error) bool {
+	return target == ErrRecipient
+}
+
+// Is() lets a SendError match the sentinel error for its stage - eg,
+// errors.Is(err, ErrAuth) for a failure at StageAuth.
+func (e *SendError) Is(target error) bool {
+	return target == stageErrors[e.Stage]
+}
+
+// Temporary() reports whether the failure might go away if the message is
+// sent again later - eg, a 4xx reply or the server being unreachable.
+// Permanent rejections (5xx), bad certificates and the like are not
+// temporary.
+func (e *SendError) Temporary() bool {
+	if e.Stage == StageRcpt && len(e.Recipients) > 0 {
+		for _, re := range e.Recipients {
+			if re.Temporary() {
+				return true
+			}
+		}
+		return false
+	}
+	if e.Code > 0 {
+		return e.Code >= 400 && e.Code < 500
+	}
+	if errors.Is(e.Err, context.Canceled) {
+		return false
+	}
+	if errors.Is(e.Err, context.DeadlineExceeded) ||
+		errors.Is(e.Err, io.EOF) || errors.Is(e.Err, io.ErrUnexpectedEOF) {
+		return true
+	}
+	// network trouble - timeouts, refused connections and so on
+	var netErr net.Error
+	return errors.As(e.Err, &netErr)
+}
+
+// IsTemporary() reports whether an error returned when sending a message is
+// worth retrying. Only SMTP failures can be temporary - problems with the
+// message or config will be the same next time.
+func IsTemporary(err error) bool {
+	var se *SendError
+	if errors.As(err, &se) {
+		return se.Temporary()
+	}
+	return false
+}
+
+// HeaderError describes a problem with a single header field - eg, an
+// invalid address. Address is empty if the problem is with the field as a
+// whole.
+type HeaderError struct {
+	Field   string // eg, "To"
+	Address string
+	Msg     string
+}
+
+func (e HeaderError) Error() string {
+	if len(e.Address) > 0 {
+		return e.Field + ": " + e.Address + ": " + e.Msg
+	}
+	return e.Field + ": " + e.Msg
+}
+
+// Is() makes errors.Is(err, ErrHeaders) true for a HeaderError.
+func (e HeaderError) Is(target error) bool {
+	return target == ErrHeaders
+}
+
+// HeaderErrors is the list of problems found when checking the headers.
+type HeaderErrors []HeaderError
+
+func (e HeaderErrors) Error() string {
+	msgs := make([]string, len(e))
+	for i, he := range e {
+		msgs[i] = he.Error()
+	}
+	return strings.Join(msgs, "; ")
+}
+
+// Is() makes errors.Is(err, ErrHeaders) true for HeaderErrors.
+func (e HeaderErrors) Is(target error) bool {
+	return target == ErrHeaders
+}
+
+// Is() makes errors.Is(err, ErrConfig) true for ConfigErrors.
+func (e ConfigErrors) Is(target error) bool {
+	return target == ErrConfig
+}
+
+// newSendError() creates a SendError, picking out the SMTP reply code if
+// the underlying error came from the server.
+func newSendError(stage Stage, err error) *SendError {
+	return &SendError{Stage: stage, Code: replyCode(err), Err: err}
+}
+
+// newRecipientError() records the rejection of a recipient.
+func newRecipientError(addr string, err error) *RecipientError {
+	return &RecipientError{Address: addr, Code: replyCode(err), Err: err}
+}
+
+// replyCode() gets the SMTP reply code from an error, or 0 if it doesn't
+// have one.
+func replyCode(err error) int {
+	var tpErr *textproto.Error
+	if errors.As(err, &tpErr) {
+		return tpErr.Code
+	}
+	return 0
+}
+
+// recipientsError() summarises a list of rejected recipients.
+func recipientsError(rejected []*RecipientError) error {
+	msgs := make([]string, len(rejected))
+	for i, re := range rejected {
+		msgs[i] = re.Error()
+	}
+	return errors.New(strconv.Itoa(len(rejected)) + " recipient(s) rejected: " +
+		strings.Join(msgs, "; "))
+}
@@ -0,0 +1,535 @@
+/*
+Inbound mail for emailutils.
+
+FetchMessages() collects new messages from an IMAP or POP3 mailbox, so that
+devices can act on instructions sent to them by email. A MailPoller does
+the same thing at regular intervals, handing each message to a function.
+
+The settings use the same config file conventions, and can live in the same
+file as the outgoing settings:
+
+	in_protocol=imap          imap or pop3
+	in_host=mail.example.com
+	in_port=993               defaults to 993 (imap) or 995 (pop3) with TLS,
+	                          143 or 110 without
+	in_tls=yes                connect with TLS (the default)
+	in_allow_plaintext=no     allow logging in without TLS to hosts other
+	                          than localhost
+	in_user=device@example.com    defaults to 'user'
+	in_pass=top_secret_password   defaults to 'pass'
+	in_mailbox=INBOX          IMAP only
+	in_delete=no              delete messages from the server once fetched
+	poll_interval=1m          used by MailPoller
+
+The tls_ca_file, tls_server_name and tls_insecure keys apply to these
+connections too. As with SMTP, the password is only sent without TLS to
+localhost, unless in_allow_plaintext=yes.
+
+With IMAP, only unseen messages are fetched and they are then marked as
+seen. POP3 has no such flag, so FetchMessages() fetches every message in the
+mailbox each time - setting in_delete=yes is usually wise. A MailPoller
+remembers the messages it has already fetched (by their UIDL), so each is
+handled only once even if it's left on the server.
+*/
+
+package emailutils
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultPollInterval = time.Minute
+	// time allowed for each command when fetching
+	fetchTimeout = time.Minute
+	// largest IMAP literal (usually a whole message) that will be accepted
+	maxLiteralSize = 64 << 20
+)
+
+// FetchMessages() retrieves new messages from the mailbox described by the
+// config map.
+func FetchMessages(cfg map[string]string) ([]EmailMessage, error) {
+	return parseMessages(fetchRaw(cfg, nil))
+}
+
+// parseMessages() parses fetched messages. Any that can't be parsed are
+// left out, with the first error returned unless there's already one.
+func parseMessages(raw [][]byte, err error) ([]EmailMessage, error) {
+	msgs := []EmailMessage{}
+	for _, data := range raw {
+		msg, perr := ParseMessage(bytes.NewReader(data))
+		if perr != nil {
+			if err == nil {
+				err = perr
+			}
+			continue
+		}
+		msgs = append(msgs, msg)
+	}
+	return msgs, err
+}
+
+// fetchRaw() retrieves new messages, unparsed, using the protocol given in
+// the config map. For POP3, if seen isn't nil, messages whose UIDLs are in it
+// are skipped and it's updated with those fetched.
+func fetchRaw(cfg map[string]string, seen map[string]bool) ([][]byte, error) {
+	inCfg, err := inboundConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+	useTLS, _ := parseBool(inCfg["in_tls"])
+	allow, _ := parseBool(inCfg["in_allow_plaintext"])
+	if !useTLS && !allow && !isLocalhost(inCfg["in_host"]) {
+		return nil, fmt.Errorf("%w: unencrypted connection - use in_tls=yes "+
+			"(or in_allow_plaintext=yes to send the password anyway)", ErrAuth)
+	}
+	conn, err := dialInbound(cfg, inCfg)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if inCfg["in_protocol"] == "pop3" {
+		return fetchPOP3(conn, inCfg, seen)
+	}
+	return fetchIMAP(conn, inCfg)
+}
+
+// inboundConfig() checks the in_* settings and fills in defaults.
+func inboundConfig(cfg map[string]string) (map[string]string, error) {
+	var errs = []string{}
+	in := map[string]string{}
+	for _, key := range []string{"in_protocol", "in_host", "in_port", "in_tls",
+		"in_user", "in_pass", "in_mailbox", "in_delete", "in_allow_plaintext"} {
+		in[key] = cfg[key]
+	}
+	in["in_protocol"] = strings.ToLower(in["in_protocol"])
+	if len(in["in_protocol"]) == 0 {
+		in["in_protocol"] = "imap"
+	}
+	if in["in_protocol"] != "imap" && in["in_protocol"] != "pop3" {
+		errs = append(errs, "Invalid config value: in_protocol")
+	}
+	if len(in["in_host"]) == 0 {
+		errs = append(errs, "Missing config value: in_host")
+	}
+	if len(in["in_tls"]) == 0 {
+		in["in_tls"] = "yes"
+	}
+	useTLS, err := parseBool(in["in_tls"])
+	if err != nil {
+		errs = append(errs, "Invalid config value: in_tls")
+	}
+	if len(in["in_port"]) == 0 {
+		ports := map[string]string{"imap": "143", "pop3": "110"}
+		if useTLS {
+			ports = map[string]string{"imap": "993", "pop3": "995"}
+		}
+		in["in_port"] = ports[in["in_protocol"]]
+	}
+	if len(in["in_user"]) == 0 {
+		in["in_user"] = cfg["user"]
+	}
+	if len(in["in_pass"]) == 0 {
+		in["in_pass"] = cfg["pass"]
+	}
+	if len(in["in_user"]) == 0 {
+		errs = append(errs, "Missing config value: in_user")
+	}
+	if len(in["in_mailbox"]) == 0 {
+		in["in_mailbox"] = "INBOX"
+	}
+	if _, err = parseBool(in["in_delete"]); err != nil {
+		errs = append(errs, "Invalid config value: in_delete")
+	}
+	if _, err = parseBool(in["in_allow_plaintext"]); err != nil {
+		errs = append(errs, "Invalid config value: in_allow_plaintext")
+	}
+	if len(errs) > 0 {
+		return nil, fmt.Errorf("%w: %s", ErrConfig, strings.Join(errs[:], "; "))
+	}
+	return in, nil
+}
+
+// dialInbound() connects to the IMAP or POP3 server.
+func dialInbound(cfg map[string]string, in map[string]string) (net.Conn, error) {
+	addr := net.JoinHostPort(in["in_host"], in["in_port"])
+	dialer := &net.Dialer{Timeout: fetchTimeout}
+	if useTLS, _ := parseBool(in["in_tls"]); !useTLS {
+		conn, err := dialer.Dial("tcp", addr)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrConnection, err)
+		}
+		return conn, nil
+	}
+	tlsCfg, err := tlsConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+	if len(cfg["tls_server_name"]) == 0 {
+		tlsCfg.ServerName = in["in_host"]
+	}
+	conn, err := tls.DialWithDialer(dialer, "tcp", addr, tlsCfg)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrConnection, err)
+	}
+	return conn, nil
+}
+
+/******************************************************************************
+ *****   POP3                                                             *****
+ ******************************************************************************/
+
+// pop3Cmd() sends a POP3 command and checks for a +OK reply, which is
+// returned without the status indicator.
+func pop3Cmd(tp *textproto.Conn, conn net.Conn, format string, args ...interface{}) (string, error) {
+	conn.SetDeadline(time.Now().Add(fetchTimeout))
+	if len(format) > 0 {
+		if err := tp.PrintfLine(format, args...); err != nil {
+			return "", err
+		}
+	}
+	line, err := tp.ReadLine()
+	if err != nil {
+		return "", err
+	}
+	if !strings.HasPrefix(line, "+OK") {
+		return "", errors.New("POP3 error: " + line)
+	}
+	return strings.TrimSpace(strings.TrimPrefix(line, "+OK")), nil
+}
+
+// fetchPOP3() retrieves every message in a POP3 mailbox, apart from those
+// whose UIDLs are in seen (if it isn't nil).
+func fetchPOP3(conn net.Conn, in map[string]string, seen map[string]bool) ([][]byte, error) {
+	tp := textproto.NewConn(conn)
+	if _, err := pop3Cmd(tp, conn, ""); err != nil { // greeting
+		return nil, fmt.Errorf("%w: %v", ErrConnection, err)
+	}
+	if _, err := pop3Cmd(tp, conn, "USER %s", in["in_user"]); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrAuth, err)
+	}
+	if _, err := pop3Cmd(tp, conn, "PASS %s", in["in_pass"]); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrAuth, err)
+	}
+	stat, err := pop3Cmd(tp, conn, "STAT")
+	if err != nil {
+		return nil, err
+	}
+	fields := strings.Fields(stat)
+	if len(fields) == 0 {
+		return nil, errors.New("POP3 error: bad STAT reply: " + stat)
+	}
+	count, err := strconv.Atoi(fields[0])
+	if err != nil {
+		return nil, errors.New("POP3 error: bad STAT reply: " + stat)
+	}
+	del, _ := parseBool(in["in_delete"])
+	uidls := map[int]string{}
+	if seen != nil {
+		if uidls, err = pop3UIDLs(tp, conn); err != nil && !del {
+			// without UIDLs, the same messages would be fetched every time
+			return nil, fmt.Errorf("%v - set in_delete=yes if the server doesn't support UIDL", err)
+		}
+		// forget messages that are no longer on the server
+		current := map[string]bool{}
+		for _, uidl := range uidls {
+			current[uidl] = true
+		}
+		for uidl := range seen {
+			if !current[uidl] {
+				delete(seen, uidl)
+			}
+		}
+	}
+	msgs := [][]byte{}
+	for i := 1; i <= count; i++ {
+		uidl := uidls[i]
+		if seen != nil && len(uidl) > 0 && seen[uidl] {
+			continue
+		}
+		if _, err = pop3Cmd(tp, conn, "RETR %d", i); err != nil {
+			return msgs, err
+		}
+		data, err := tp.ReadDotBytes()
+		if err != nil {
+			return msgs, err
+		}
+		msgs = append(msgs, data)
+		if seen != nil && len(uidl) > 0 {
+			seen[uidl] = true
+		}
+		if del {
+			if _, err = pop3Cmd(tp, conn, "DELE %d", i); err != nil {
+				return msgs, err
+			}
+		}
+	}
+	// deletions only happen once QUIT succeeds
+	_, err = pop3Cmd(tp, conn, "QUIT")
+	return msgs, err
+}
+
+// pop3UIDLs() lists the unique IDs of the messages in the mailbox, by
+// message number.
+func pop3UIDLs(tp *textproto.Conn, conn net.Conn) (map[int]string, error) {
+	uidls := map[int]string{}
+	if _, err := pop3Cmd(tp, conn, "UIDL"); err != nil {
+		return uidls, err
+	}
+	lines, err := tp.ReadDotLines()
+	if err != nil {
+		return uidls, err
+	}
+	for _, line := range lines {
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			continue
+		}
+		if n, err := strconv.Atoi(fields[0]); err == nil {
+			uidls[n] = fields[1]
+		}
+	}
+	return uidls, nil
+}
+
+/******************************************************************************
+ *****   IMAP                                                             *****
+ ******************************************************************************/
+
+// imapClient is just enough of an IMAP4rev1 client to fetch messages.
+type imapClient struct {
+	conn net.Conn
+	r    *bufio.Reader
+	tag  int
+}
+
+// cmd() sends a command and collects the untagged responses (with any
+// literals they contain) until the tagged completion.
+func (c *imapClient) cmd(format string, args ...interface{}) ([]imapResponse, error) {
+	c.tag++
+	tag := "A" + strconv.Itoa(c.tag)
+	c.conn.SetDeadline(time.Now().Add(fetchTimeout))
+	if _, err := fmt.Fprintf(c.conn, tag+" "+format+"\r\n", args...); err != nil {
+		return nil, err
+	}
+	responses := []imapResponse{}
+	for {
+		resp, err := c.readResponse()
+		if err != nil {
+			return responses, err
+		}
+		if strings.HasPrefix(resp.line, tag+" ") {
+			status := strings.TrimPrefix(resp.line, tag+" ")
+			if !strings.HasPrefix(strings.ToUpper(status), "OK") {
+				return responses, errors.New("IMAP error: " + status)
+			}
+			return responses, nil
+		}
+		responses = append(responses, resp)
+	}
+}
+
+// imapResponse is a single response line, plus the contents of any
+// literal ({n} followed by n bytes) within it.
+type imapResponse struct {
+	line     string
+	literals [][]byte
+}
+
+// readResponse() reads a response, including any literals.
+func (c *imapClient) readResponse() (imapResponse, error) {
+	var resp imapResponse
+	for {
+		line, err := c.r.ReadString('\n')
+		if err != nil {
+			return resp, err
+		}
+		line = strings.TrimRight(line, "\r\n")
+		resp.line += line
+		// a literal is announced by {size} at the end of the line
+		if !strings.HasSuffix(line, "}") {
+			return resp, nil
+		}
+		open := strings.LastIndex(line, "{")
+		if open < 0 {
+			return resp, nil
+		}
+		size, err := strconv.Atoi(line[open+1 : len(line)-1])
+		if err != nil {
+			return resp, nil
+		}
+		// the size comes from the server, so don't trust it
+		if size < 0 || size > maxLiteralSize {
+			return resp, errors.New("IMAP error: bad literal size: " + strconv.Itoa(size))
+		}
+		data := make([]byte, size)
+		if _, err = io.ReadFull(c.r, data); err != nil {
+			return resp, err
+		}
+		resp.literals = append(resp.literals, data)
+	}
+}
+
+// imapQuote() turns a string into an IMAP quoted string.
+func imapQuote(s string) string {
+	return "\"" + strings.NewReplacer("\\", "\\\\", "\"", "\\\"").Replace(s) + "\""
+}
+
+// fetchIMAP() retrieves the unseen messages from an IMAP mailbox and marks
+// them as seen (or deletes them).
+func fetchIMAP(conn net.Conn, in map[string]string) ([][]byte, error) {
+	c := &imapClient{conn: conn, r: bufio.NewReader(conn)}
+	conn.SetDeadline(time.Now().Add(fetchTimeout))
+	greeting, err := c.readResponse()
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrConnection, err)
+	}
+	if !strings.HasPrefix(greeting.line, "* OK") {
+		return nil, fmt.Errorf("%w: IMAP error: %s", ErrConnection, greeting.line)
+	}
+	if _, err = c.cmd("LOGIN %s %s", imapQuote(in["in_user"]), imapQuote(in["in_pass"])); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrAuth, err)
+	}
+	defer c.cmd("LOGOUT")
+	if _, err = c.cmd("SELECT %s", imapQuote(in["in_mailbox"])); err != nil {
+		return nil, err
+	}
+	resps, err := c.cmd("UID SEARCH UNSEEN")
+	if err != nil {
+		return nil, err
+	}
+	uids := []string{}
+	for _, resp := range resps {
+		if strings.HasPrefix(strings.ToUpper(resp.line), "* SEARCH") {
+			uids = append(uids, strings.Fields(resp.line)[2:]...)
+		}
+	}
+	del, _ := parseBool(in["in_delete"])
+	msgs := [][]byte{}
+	for _, uid := range uids {
+		// PEEK so the message isn't marked as seen unless we get all of it
+		resps, err = c.cmd("UID FETCH %s (BODY.PEEK[])", uid)
+		if err != nil {
+			return msgs, err
+		}
+		for _, resp := range resps {
+			if len(resp.literals) > 0 {
+				msgs = append(msgs, resp.literals[0])
+			}
+		}
+		flags := `(\Seen)`
+		if del {
+			flags = `(\Seen \Deleted)`
+		}
+		if _, err = c.cmd("UID STORE %s +FLAGS.SILENT %s", uid, flags); err != nil {
+			return msgs, err
+		}
+	}
+	if del && len(uids) > 0 {
+		_, err = c.cmd("EXPUNGE")
+	}
+	return msgs, err
+}
+
+/******************************************************************************
+ *****   POLLING                                                          *****
+ ******************************************************************************/
+
+// MailPoller checks a mailbox at regular intervals and passes each new
+// message to Handler.
+type MailPoller struct {
+	Config   map[string]string
+	Interval time.Duration
+	Handler  func(msg EmailMessage) error
+	Errors   func(err error) // optional - called when fetching fails
+
+	pollMu sync.Mutex      // held while polling
+	seen   map[string]bool // UIDLs of POP3 messages already fetched
+	mu     sync.Mutex
+	stop   chan struct{}
+	done   chan struct{}
+}
+
+// NewMailPoller() creates a poller for the mailbox described by the config
+// map, with the interval taken from 'poll_interval'.
+func NewMailPoller(cfg map[string]string, handler func(msg EmailMessage) error) (*MailPoller, error) {
+	if _, err := inboundConfig(cfg); err != nil {
+		return nil, err
+	}
+	p := &MailPoller{Config: cfg, Interval: DefaultPollInterval, Handler: handler}
+	if v := cfg["poll_interval"]; len(v) > 0 {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			return nil, fmt.Errorf("%w: Invalid config value: poll_interval", ErrConfig)
+		}
+		p.Interval = d
+	}
+	return p, nil
+}
+
+// Poll() checks the mailbox once, passing each new message to the handler.
+func (p *MailPoller) Poll() error {
+	p.pollMu.Lock()
+	defer p.pollMu.Unlock()
+	if p.seen == nil {
+		p.seen = map[string]bool{}
+	}
+	msgs, err := parseMessages(fetchRaw(p.Config, p.seen))
+	for _, msg := range msgs {
+		if herr := p.Handler(msg); herr != nil && err == nil {
+			err = herr
+		}
+	}
+	return err
+}
+
+// Start() launches a background worker that polls the mailbox every
+// Interval until Stop() is called.
+func (p *MailPoller) Start() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.stop != nil {
+		return // already running
+	}
+	p.stop = make(chan struct{})
+	p.done = make(chan struct{})
+	go func(stop chan struct{}, done chan struct{}) {
+		defer close(done)
+		ticker := time.NewTicker(p.Interval)
+		defer ticker.Stop()
+		for {
+			if err := p.Poll(); err != nil && p.Errors != nil {
+				p.Errors(err)
+			}
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+			}
+		}
+	}(p.stop, p.done)
+}
+
+// Stop() halts the background worker, waiting for any poll that's in
+// progress to finish.
+func (p *MailPoller) Stop() {
+	p.mu.Lock()
+	stop, done := p.stop, p.done
+	p.stop, p.done = nil, nil
+	p.mu.Unlock()
+	if stop != nil {
+		close(stop)
+		<-done
+	}
+}
@@ -0,0 +1,330 @@
+package emailutils
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+)
+
+const fetchTestMessage = "From: Bob <bob@example.com>\r\n" +
+	"To: device@example.com\r\n" +
+	"Subject: =?utf-8?q?r=C3=A9ply_STATUS?=\r\n" +
+	"\r\n" +
+	"STATUS\r\n" +
+	".hidden dot\r\n"
+
+// fakeMailServer is a line-based server on 127.0.0.1 that records the
+// commands it receives. reply is called for each line and returns what to
+// send back, and whether to close the connection afterwards.
+type fakeMailServer struct {
+	ln       net.Listener
+	greeting string
+	reply    func(line string) (string, bool)
+	mu       sync.Mutex
+	commands []string
+}
+
+func newFakeMailServer(t *testing.T, greeting string, reply func(line string) (string, bool)) *fakeMailServer {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &fakeMailServer{ln: ln, greeting: greeting, reply: reply}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	return s
+}
+
+func (s *fakeMailServer) serve(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	fmt.Fprint(conn, s.greeting)
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		line = strings.TrimRight(line, "\r\n")
+		s.mu.Lock()
+		s.commands = append(s.commands, line)
+		s.mu.Unlock()
+		resp, done := s.reply(line)
+		fmt.Fprint(conn, resp)
+		if done {
+			return
+		}
+	}
+}
+
+func (s *fakeMailServer) port() string {
+	_, port, _ := net.SplitHostPort(s.ln.Addr().String())
+	return port
+}
+
+// sent returns the commands received, without their IMAP tags.
+func (s *fakeMailServer) sent() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	cmds := []string{}
+	for _, cmd := range s.commands {
+		if strings.HasPrefix(cmd, "A") {
+			if _, rest, ok := strings.Cut(cmd, " "); ok {
+				cmd = rest
+			}
+		}
+		cmds = append(cmds, cmd)
+	}
+	return cmds
+}
+
+func (s *fakeMailServer) received(cmd string) bool {
+	for _, c := range s.sent() {
+		if c == cmd {
+			return true
+		}
+	}
+	return false
+}
+
+// imapReply answers commands as a server holding fetchTestMessage with
+// UIDs 3 and 7.
+func imapReply(loginOK bool) func(line string) (string, bool) {
+	return func(line string) (string, bool) {
+		tag, cmd, _ := strings.Cut(line, " ")
+		switch {
+		case strings.HasPrefix(cmd, "LOGIN"):
+			if !loginOK {
+				return tag + " NO [AUTHENTICATIONFAILED] Invalid credentials\r\n", false
+			}
+		case cmd == "UID SEARCH UNSEEN":
+			return "* SEARCH 3 7\r\n" + tag + " OK SEARCH completed\r\n", false
+		case strings.HasPrefix(cmd, "UID FETCH"):
+			uid := strings.Fields(cmd)[2]
+			return fmt.Sprintf("* 1 FETCH (UID %s BODY[] {%d}\r\n%s)\r\n%s OK FETCH completed\r\n",
+				uid, len(fetchTestMessage), fetchTestMessage, tag), false
+		case cmd == "LOGOUT":
+			return "* BYE\r\n" + tag + " OK LOGOUT completed\r\n", true
+		}
+		return tag + " OK done\r\n", false
+	}
+}
+
+func inboundTestConfig(protocol string, port string) map[string]string {
+	return map[string]string{
+		"in_protocol": protocol,
+		"in_host":     "127.0.0.1",
+		"in_port":     port,
+		"in_tls":      "no",
+		"in_user":     "device@example.com",
+		"in_pass":     "secret",
+	}
+}
+
+func TestFetchIMAP(t *testing.T) {
+	srv := newFakeMailServer(t, "* OK IMAP ready\r\n", imapReply(true))
+	cfg := inboundTestConfig("imap", srv.port())
+	cfg["in_delete"] = "yes"
+	msgs, err := FetchMessages(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(msgs) != 2 {
+		t.Fatalf("got %d messages, want 2", len(msgs))
+	}
+	if msgs[0].Header.Subject != "réply STATUS" {
+		t.Errorf("Subject = %q", msgs[0].Header.Subject)
+	}
+	if !strings.Contains(msgs[0].Body, ".hidden dot") {
+		t.Errorf("Body = %q", msgs[0].Body)
+	}
+	for _, cmd := range []string{
+		`LOGIN "device@example.com" "secret"`,
+		`SELECT "INBOX"`,
+		"UID SEARCH UNSEEN",
+		"UID FETCH 3 (BODY.PEEK[])",
+		`UID STORE 3 +FLAGS.SILENT (\Seen \Deleted)`,
+		`UID STORE 7 +FLAGS.SILENT (\Seen \Deleted)`,
+		"EXPUNGE",
+	} {
+		if !srv.received(cmd) {
+			t.Errorf("server didn't receive %q - got %q", cmd, srv.sent())
+		}
+	}
+}
+
+func TestFetchIMAPKeep(t *testing.T) {
+	srv := newFakeMailServer(t, "* OK IMAP ready\r\n", imapReply(true))
+	if _, err := FetchMessages(inboundTestConfig("imap", srv.port())); err != nil {
+		t.Fatal(err)
+	}
+	if !srv.received(`UID STORE 7 +FLAGS.SILENT (\Seen)`) {
+		t.Errorf("message not marked as seen - got %q", srv.sent())
+	}
+	if srv.received("EXPUNGE") {
+		t.Error("EXPUNGE sent without in_delete=yes")
+	}
+}
+
+func TestFetchIMAPLoginFailure(t *testing.T) {
+	srv := newFakeMailServer(t, "* OK IMAP ready\r\n", imapReply(false))
+	_, err := FetchMessages(inboundTestConfig("imap", srv.port()))
+	if !errors.Is(err, ErrAuth) {
+		t.Fatalf("err = %v, want ErrAuth", err)
+	}
+}
+
+func TestIMAPReadResponseLiterals(t *testing.T) {
+	data := "* 1 FETCH (BODY[HEADER] {5}\r\nab}\r\n BODY[TEXT] {3}\r\nxyz)\r\n* 2 EXISTS\r\n"
+	c := &imapClient{r: bufio.NewReader(strings.NewReader(data))}
+	resp, err := c.readResponse()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.literals) != 2 || string(resp.literals[0]) != "ab}\r\n" || string(resp.literals[1]) != "xyz" {
+		t.Errorf("literals = %q", resp.literals)
+	}
+	if resp.line != "* 1 FETCH (BODY[HEADER] {5} BODY[TEXT] {3})" {
+		t.Errorf("line = %q", resp.line)
+	}
+	if resp, _ = c.readResponse(); resp.line != "* 2 EXISTS" {
+		t.Errorf("next line = %q", resp.line)
+	}
+}
+
+func TestIMAPReadResponseBadLiteral(t *testing.T) {
+	for _, data := range []string{
+		"* 1 FETCH (BODY[] {-1}\r\n",
+		"* 1 FETCH (BODY[] {99999999999}\r\n",
+	} {
+		c := &imapClient{r: bufio.NewReader(strings.NewReader(data))}
+		if _, err := c.readResponse(); err == nil {
+			t.Errorf("%q: no error", data)
+		}
+	}
+}
+
+// pop3Server holds a list of messages, each with a UIDL.
+type pop3Server struct {
+	mu      sync.Mutex
+	uidls   []string
+	deleted map[int]bool
+	passOK  bool
+}
+
+func (p *pop3Server) reply(line string) (string, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	cmd := strings.Fields(line)
+	switch cmd[0] {
+	case "PASS":
+		if !p.passOK {
+			return "-ERR [AUTH] invalid password\r\n", false
+		}
+	case "STAT":
+		return fmt.Sprintf("+OK %d %d\r\n", len(p.uidls), len(p.uidls)*len(fetchTestMessage)), false
+	case "UIDL":
+		resp := "+OK\r\n"
+		for i, uidl := range p.uidls {
+			resp += fmt.Sprintf("%d %s\r\n", i+1, uidl)
+		}
+		return resp + ".\r\n", false
+	case "RETR":
+		// lines starting with a dot are dot-stuffed
+		return "+OK\r\n" + strings.ReplaceAll(fetchTestMessage, "\r\n.", "\r\n..") + ".\r\n", false
+	case "DELE":
+		var n int
+		fmt.Sscan(cmd[1], &n)
+		p.deleted[n] = true
+	case "QUIT":
+		kept := []string{}
+		for i, uidl := range p.uidls {
+			if !p.deleted[i+1] {
+				kept = append(kept, uidl)
+			}
+		}
+		p.uidls, p.deleted = kept, map[int]bool{}
+		return "+OK bye\r\n", true
+	}
+	return "+OK\r\n", false
+}
+
+func TestFetchPOP3(t *testing.T) {
+	pop := &pop3Server{uidls: []string{"a1", "b2"}, deleted: map[int]bool{}, passOK: true}
+	srv := newFakeMailServer(t, "+OK POP3 ready\r\n", pop.reply)
+	cfg := inboundTestConfig("pop3", srv.port())
+	cfg["in_delete"] = "yes"
+	msgs, err := FetchMessages(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(msgs) != 2 {
+		t.Fatalf("got %d messages, want 2", len(msgs))
+	}
+	if !strings.Contains(msgs[1].Body, "\n.hidden dot") {
+		t.Errorf("dot-stuffing not undone: %q", msgs[1].Body)
+	}
+	for _, cmd := range []string{"USER device@example.com", "PASS secret", "RETR 1", "DELE 1",
+		"RETR 2", "DELE 2", "QUIT"} {
+		if !srv.received(cmd) {
+			t.Errorf("server didn't receive %q - got %q", cmd, srv.sent())
+		}
+	}
+	if len(pop.uidls) != 0 {
+		t.Errorf("messages left on server: %q", pop.uidls)
+	}
+}
+
+func TestFetchPOP3AuthFailure(t *testing.T) {
+	pop := &pop3Server{deleted: map[int]bool{}}
+	srv := newFakeMailServer(t, "+OK POP3 ready\r\n", pop.reply)
+	_, err := FetchMessages(inboundTestConfig("pop3", srv.port()))
+	if !errors.Is(err, ErrAuth) {
+		t.Fatalf("err = %v, want ErrAuth", err)
+	}
+}
+
+func TestMailPollerPOP3Seen(t *testing.T) {
+	pop := &pop3Server{uidls: []string{"a1", "b2"}, deleted: map[int]bool{}, passOK: true}
+	srv := newFakeMailServer(t, "+OK POP3 ready\r\n", pop.reply)
+	handled := 0
+	p, err := NewMailPoller(inboundTestConfig("pop3", srv.port()), func(msg EmailMessage) error {
+		handled++
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, want := range []int{2, 2, 3} {
+		if i == 2 {
+			pop.mu.Lock()
+			pop.uidls = append(pop.uidls, "c3")
+			pop.mu.Unlock()
+		}
+		if err := p.Poll(); err != nil {
+			t.Fatal(err)
+		}
+		if handled != want {
+			t.Fatalf("poll %d: %d messages handled, want %d", i+1, handled, want)
+		}
+	}
+}
+
+func TestFetchPlaintextRefused(t *testing.T) {
+	cfg := inboundTestConfig("imap", "143")
+	cfg["in_host"] = "mail.example.com"
+	if _, err := FetchMessages(cfg); !errors.Is(err, ErrAuth) {
+		t.Fatalf("err = %v, want ErrAuth", err)
+	}
+}
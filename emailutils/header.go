@@ -0,0 +1,114 @@
+/*
+Header rendering for emailutils.
+
+Headers are written as per RFC 5322: names are quoted where necessary, any
+non-ASCII text is sent as RFC 2047 encoded words and long fields are folded
+so that no line runs beyond 78 characters.
+*/
+
+package emailutils
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"mime"
+	"net/mail"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// recommended maximum line length for headers (RFC 5322 2.1.1)
+	maxHeaderLen = 78
+)
+
+// foldHeader() renders a header field, folding it onto continuation lines at
+// spaces so that, as far as possible, no line is longer than maxHeaderLen.
+func foldHeader(name string, value string) string {
+	var out strings.Builder
+	line := name + ":"
+	for i, word := range strings.Split(value, " ") {
+		if i > 0 && len(line)+1+len(word) > maxHeaderLen {
+			out.WriteString(line + "\r\n")
+			line = ""
+		}
+		line += " " + word
+	}
+	out.WriteString(line + "\r\n")
+	return out.String()
+}
+
+// headerLine() folds an already-formatted "Name: value" header line.
+func headerLine(line string) string {
+	parts := strings.SplitN(line, ": ", 2)
+	if len(parts) < 2 {
+		return line + "\r\n"
+	}
+	return foldHeader(parts[0], parts[1])
+}
+
+// encodeHeaderText() encodes free text, such as a subject line, as RFC 2047
+// encoded words if it contains anything other than printable ASCII.
+func encodeHeaderText(text string) string {
+	return mime.QEncoding.Encode("utf-8", text)
+}
+
+// formatAddress() renders a single address, with optional display name, in
+// a form suitable for use in a header. The name is quoted or encoded as
+// necessary.
+func formatAddress(name string, addr string) string {
+	// the address may itself be in 'Name <addr>' form, and may have an
+	// internationalised domain
+	parsed, err := ParseAddress(addr)
+	if err != nil {
+		return addr
+	}
+	if len(name) > 0 {
+		parsed.Name = name
+	}
+	if len(parsed.Name) == 0 {
+		return parsed.Address
+	}
+	return parsed.String()
+}
+
+// formatAddressList() renders a list of addresses, separated by commas.
+func formatAddressList(addrs []string) string {
+	formatted := make([]string, len(addrs))
+	for i, addr := range addrs {
+		formatted[i] = formatAddress("", addr)
+	}
+	return strings.Join(formatted, ", ")
+}
+
+// envelopeAddress() strips any display name from an address, leaving just
+// the part that's needed for the SMTP envelope, with the domain in ASCII.
+func envelopeAddress(addr string) string {
+	if parsed, err := ParseAddress(addr); err == nil {
+		return parsed.Address
+	}
+	return addr
+}
+
+// newMessageID() creates a unique message identifier, using the domain of
+// the sender's address (or the local hostname, if that's not available).
+func newMessageID(from string) string {
+	domain := ""
+	if parsed, err := mail.ParseAddress(from); err == nil {
+		if idx := strings.LastIndex(parsed.Address, "@"); idx >= 0 {
+			domain = parsed.Address[idx+1:]
+		}
+	}
+	if len(domain) == 0 {
+		domain, _ = os.Hostname()
+		if len(domain) == 0 {
+			domain = "localhost"
+		}
+	}
+	rnd := make([]byte, 12)
+	rand.Read(rnd)
+	return "<" + strconv.FormatInt(time.Now().UnixNano(), 36) + "." +
+		hex.EncodeToString(rnd) + "@" + domain + ">"
+}
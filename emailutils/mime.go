@@ -0,0 +1,257 @@
+/*
+MIME support for emailutils.
+
+Every message is rendered as MIME. The structure depends on what has been
+added to the message:
+
+	text only                 -> text/plain
+	text + HTML               -> multipart/alternative
+	text (+ HTML) + files     -> multipart/mixed
+
+Text parts are sent as 7bit if they're plain ASCII with short enough lines,
+otherwise as quoted-printable. Attachments are sent as base64 unless the
+Attachment says otherwise.
+*/
+
+package emailutils
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"mime"
+	"mime/quotedprintable"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	EncodingBase64          = "base64"
+	EncodingQuotedPrintable = "quoted-printable"
+	Encoding7Bit            = "7bit"
+	// maximum length of an encoded line, as per RFC 2045
+	mimeLineLen = 76
+	// maximum length of any line, as per RFC 5322
+	maxLineLen = 998
+)
+
+// Attachment holds a file to be sent along with the message.
+type Attachment struct {
+	Filename    string // name offered to the recipient
+	ContentType string // eg, "text/plain" - defaults to application/octet-stream
+	Encoding    string // EncodingBase64 (default) or EncodingQuotedPrintable
+	Data        []byte // raw, unencoded content
+}
+
+// mimePart is a rendered MIME entity - its own headers plus encoded body.
+type mimePart struct {
+	header []string
+	body   []byte
+}
+
+// AddAttachment() adds some data to the message as a file attachment.
+func (e *EmailMessage) AddAttachment(filename string, contentType string, data []byte) {
+	e.Attachments = append(e.Attachments, Attachment{
+		Filename:    filename,
+		ContentType: contentType,
+		Data:        data,
+	})
+}
+
+// AttachFile() reads a file from disk and adds it as an attachment. The
+// content type is guessed from the file extension.
+func (e *EmailMessage) AttachFile(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("attachfile : %v", err)
+	}
+	e.AddAttachment(filepath.Base(path), mime.TypeByExtension(filepath.Ext(path)), data)
+	return nil
+}
+
+// HTMLSet() sets an HTML version of the message, to be sent alongside the
+// plain-text Body as a multipart/alternative.
+func (e *EmailMessage) HTMLSet(html string) {
+	e.HTMLBody = html + "\r\n"
+}
+
+// HTMLAppend() adds text to any existing HTML version of the message.
+func (e *EmailMessage) HTMLAppend(html string) {
+	e.HTMLBody += html + "\r\n"
+}
+
+// IsMultipart() reports whether the message needs to be sent as MIME
+// multipart - ie, it has an HTML alternative or attachments.
+func (e EmailMessage) IsMultipart() bool {
+	return len(e.HTMLBody) > 0 || len(e.Attachments) > 0
+}
+
+// Bytes() renders the complete message - headers and body - ready to be
+// handed to an SMTP server.
+func (e EmailMessage) Bytes() []byte {
+	var buf bytes.Buffer
+	buf.WriteString(e.HeaderString())
+	buf.Write(e.mimeEntity().body)
+	return buf.Bytes()
+}
+
+// mimeHeaders() returns the top-level MIME header lines for the message.
+func (e EmailMessage) mimeHeaders() string {
+	hdrStr := "MIME-Version: 1.0\r\n"
+	for _, line := range e.mimeEntity().header {
+		hdrStr += headerLine(line)
+	}
+	return hdrStr
+}
+
+// mimeEntity() builds the MIME structure of the message.
+func (e EmailMessage) mimeEntity() mimePart {
+	hash := e.contentHash()
+	var content mimePart
+	if len(e.HTMLBody) > 0 {
+		content = multipartEntity("alternative", "alt-"+hash, []mimePart{
+			textPart("text/plain", e.Body),
+			textPart("text/html", e.HTMLBody),
+		})
+	} else {
+		content = textPart("text/plain", e.Body)
+	}
+	if len(e.Attachments) == 0 {
+		return content
+	}
+	parts := []mimePart{content}
+	for _, att := range e.Attachments {
+		parts = append(parts, att.part())
+	}
+	return multipartEntity("mixed", "mix-"+hash, parts)
+}
+
+// contentHash() is used to build multipart boundaries. Deriving them from
+// the content means HeaderString() and Bytes() agree on the boundary without
+// having to store it anywhere, and the same message always renders the same.
+func (e EmailMessage) contentHash() string {
+	h := sha1.New()
+	h.Write([]byte(e.Body))
+	h.Write([]byte(e.HTMLBody))
+	for _, att := range e.Attachments {
+		h.Write([]byte(att.Filename))
+		h.Write(att.Data)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// part() renders an attachment as a MIME entity.
+func (att Attachment) part() mimePart {
+	ctype := att.ContentType
+	if len(ctype) == 0 {
+		ctype = "application/octet-stream"
+	}
+	// the type may already have parameters, eg "text/plain; charset=utf-8"
+	mediaType, params, err := mime.ParseMediaType(ctype)
+	if err != nil {
+		mediaType, params = "application/octet-stream", map[string]string{}
+	}
+	params["name"] = att.Filename
+	p := mimePart{header: []string{
+		"Content-Type: " + mime.FormatMediaType(mediaType, params),
+		"Content-Disposition: " + mime.FormatMediaType("attachment",
+			map[string]string{"filename": att.Filename}),
+	}}
+	if att.Encoding == EncodingQuotedPrintable {
+		p.header = append(p.header, "Content-Transfer-Encoding: "+EncodingQuotedPrintable)
+		p.body = encodeQuotedPrintable(att.Data)
+	} else {
+		p.header = append(p.header, "Content-Transfer-Encoding: "+EncodingBase64)
+		p.body = encodeBase64(att.Data)
+	}
+	return p
+}
+
+// textPart() creates a text entity, using 7bit encoding if the text allows
+// it and quoted-printable otherwise.
+func textPart(ctype string, text string) mimePart {
+	// all line endings should be CRLF
+	text = strings.ReplaceAll(strings.ReplaceAll(text, "\r\n", "\n"), "\n", "\r\n")
+	if is7Bit(text) {
+		return mimePart{
+			header: []string{
+				"Content-Type: " + ctype + "; charset=\"us-ascii\"",
+				"Content-Transfer-Encoding: " + Encoding7Bit,
+			},
+			body: []byte(text),
+		}
+	}
+	return mimePart{
+		header: []string{
+			"Content-Type: " + ctype + "; charset=\"utf-8\"",
+			"Content-Transfer-Encoding: " + EncodingQuotedPrintable,
+		},
+		body: encodeQuotedPrintable([]byte(text)),
+	}
+}
+
+// is7Bit() checks whether text can be sent without any encoding - ie, it's
+// all ASCII, with no lone CRs or LFs and no over-long lines.
+func is7Bit(text string) bool {
+	for _, line := range strings.Split(text, "\r\n") {
+		if len(line) > maxLineLen {
+			return false
+		}
+		for i := 0; i < len(line); i++ {
+			if line[i] >= 0x80 || line[i] == 0 || line[i] == '\r' || line[i] == '\n' {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// multipartEntity() wraps a set of parts in a multipart container.
+func multipartEntity(subtype string, boundary string, parts []mimePart) mimePart {
+	var buf bytes.Buffer
+	for _, p := range parts {
+		buf.WriteString("--" + boundary + "\r\n")
+		for _, line := range p.header {
+			buf.WriteString(headerLine(line))
+		}
+		buf.WriteString("\r\n")
+		buf.Write(p.body)
+		// the CRLF before a boundary belongs to the boundary, not the part
+		buf.WriteString("\r\n")
+	}
+	buf.WriteString("--" + boundary + "--\r\n")
+	return mimePart{
+		header: []string{"Content-Type: multipart/" + subtype + "; boundary=\"" + boundary + "\""},
+		body:   buf.Bytes(),
+	}
+}
+
+// encodeBase64() encodes data as base64, split into lines of the
+// maximum permitted length.
+func encodeBase64(data []byte) []byte {
+	enc := base64.StdEncoding.EncodeToString(data)
+	var buf bytes.Buffer
+	for len(enc) > mimeLineLen {
+		buf.WriteString(enc[:mimeLineLen] + "\r\n")
+		enc = enc[mimeLineLen:]
+	}
+	if len(enc) > 0 {
+		buf.WriteString(enc + "\r\n")
+	}
+	return buf.Bytes()
+}
+
+// encodeQuotedPrintable() encodes data as quoted-printable with CRLF
+// line endings.
+func encodeQuotedPrintable(data []byte) []byte {
+	var buf bytes.Buffer
+	w := quotedprintable.NewWriter(&buf)
+	// normalise line endings first, otherwise lone CRs get encoded
+	text := strings.ReplaceAll(string(data), "\r\n", "\n")
+	w.Write([]byte(text))
+	w.Close()
+	return buf.Bytes()
+}
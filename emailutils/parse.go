@@ -0,0 +1,278 @@
+/*
+Message parsing for emailutils.
+
+ParseMessage() reads a raw RFC 5322 message and turns it into an
+EmailMessage - the reverse of rendering one with Bytes(). This makes it
+possible to load .eml files (such as those written by the maildir
+transport), re-send bounced mail and check what a test actually sent:
+
+	msg, err := emailutils.ReadMessageFile("/var/spool/email/new/1234.eml")
+
+Encoded headers are decoded and MIME bodies are unpacked, however deeply
+nested:
+
+  - the first text/plain part becomes the Body and the first text/html part
+    the HTMLBody
+  - parts marked as attachments, or with a filename, become Attachments,
+    as does any other part that isn't one of the alternatives of a
+    multipart/alternative
+
+Date and Message-ID are kept, so re-sending a parsed message preserves
+them. Line endings in the text are always CRLF, as with BodySet().
+*/
+
+package emailutils
+
+import (
+	"encoding/base64"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"net/textproto"
+	"os"
+	"strings"
+)
+
+// ParseMessage() reads a message and converts it to an EmailMessage.
+func ParseMessage(r io.Reader) (EmailMessage, error) {
+	var msg EmailMessage
+	m, err := mail.ReadMessage(r)
+	if err != nil {
+		return msg, fmt.Errorf("Error reading message: %v", err)
+	}
+	dec := &mime.WordDecoder{CharsetReader: charsetReader}
+	if from, err := parseAddressList(m.Header, "From", dec); err == nil && len(from) > 0 {
+		msg.Header.Name = from[0].Name
+		msg.Header.From = from[0].Address
+	} else {
+		msg.Header.From = strings.TrimSpace(m.Header.Get("From"))
+	}
+	msg.Header.To = addressStrings(m.Header, "To", dec)
+	msg.Header.Cc = addressStrings(m.Header, "Cc", dec)
+	msg.Header.Bcc = addressStrings(m.Header, "Bcc", dec)
+	msg.Header.ReplyTo = addressStrings(m.Header, "Reply-To", dec)
+	msg.Header.Subject = decodeHeaderText(m.Header.Get("Subject"), dec)
+	if date, err := m.Header.Date(); err == nil {
+		msg.Header.Date = date
+	}
+	msg.Header.MessageID = strings.TrimSpace(m.Header.Get("Message-Id"))
+	err = parseEntity(&msg, textproto.MIMEHeader(m.Header), m.Body, "", dec)
+	return msg, err
+}
+
+// ReadMessageFile() reads a message from a file, such as a .eml file or
+// one in a maildir, and converts it to an EmailMessage.
+func ReadMessageFile(path string) (EmailMessage, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return EmailMessage{}, fmt.Errorf("readmessagefile : %v", err)
+	}
+	defer f.Close()
+	return ParseMessage(f)
+}
+
+// parseEntity() unpacks a MIME entity, adding the text or attachment it
+// holds to the message. 'parent' is the media type of the multipart
+// container the entity is in, if any.
+func parseEntity(msg *EmailMessage, header textproto.MIMEHeader, body io.Reader,
+	parent string, dec *mime.WordDecoder) error {
+	ctype := header.Get("Content-Type")
+	if len(ctype) == 0 {
+		ctype = "text/plain"
+		if parent == "multipart/digest" {
+			ctype = "message/rfc822"
+		}
+	}
+	mediaType, params, err := mime.ParseMediaType(ctype)
+	if err != nil {
+		// treat anything we can't make sense of as plain text
+		mediaType, params = "text/plain", map[string]string{}
+	}
+	if strings.HasPrefix(mediaType, "multipart/") {
+		mr := multipart.NewReader(body, params["boundary"])
+		for {
+			part, err := mr.NextRawPart()
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return fmt.Errorf("Error reading MIME part: %v", err)
+			}
+			if err = parseEntity(msg, part.Header, part, mediaType, dec); err != nil {
+				return err
+			}
+		}
+	}
+	encoding := strings.ToLower(strings.TrimSpace(header.Get("Content-Transfer-Encoding")))
+	data, err := io.ReadAll(decodeTransfer(encoding, body))
+	if err != nil {
+		return fmt.Errorf("Error decoding message body: %v", err)
+	}
+	disposition, dparams, _ := mime.ParseMediaType(header.Get("Content-Disposition"))
+	filename := dparams["filename"]
+	if len(filename) == 0 {
+		filename = params["name"]
+	}
+	if disposition != "attachment" && len(filename) == 0 {
+		switch {
+		case mediaType == "text/plain" && len(msg.Body) == 0:
+			msg.Body = crlfText(decodeCharset(params["charset"], data))
+			return nil
+		case mediaType == "text/html" && len(msg.HTMLBody) == 0:
+			msg.HTMLBody = crlfText(decodeCharset(params["charset"], data))
+			return nil
+		case parent == "multipart/alternative":
+			// an alternative version of the text that we have no use for
+			return nil
+		}
+	}
+	att := Attachment{
+		Filename:    decodeHeaderText(filename, dec),
+		ContentType: mediaType,
+		Data:        data,
+	}
+	if encoding == EncodingQuotedPrintable {
+		att.Encoding = EncodingQuotedPrintable
+	}
+	msg.Attachments = append(msg.Attachments, att)
+	return nil
+}
+
+// decodeTransfer() undoes a Content-Transfer-Encoding, given in lower case.
+func decodeTransfer(encoding string, r io.Reader) io.Reader {
+	switch encoding {
+	case EncodingBase64:
+		return base64.NewDecoder(base64.StdEncoding, &base64Cleaner{r: r})
+	case EncodingQuotedPrintable:
+		return quotedprintable.NewReader(r)
+	}
+	return r
+}
+
+// base64Cleaner strips the line breaks (and any other whitespace) out of
+// base64 data, which the standard decoder won't tolerate.
+type base64Cleaner struct {
+	r io.Reader
+}
+
+func (c *base64Cleaner) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	j := 0
+	for i := 0; i < n; i++ {
+		switch p[i] {
+		case '\r', '\n', ' ', '\t':
+		default:
+			p[j] = p[i]
+			j++
+		}
+	}
+	if j == 0 && n > 0 && err == nil {
+		// everything was whitespace - read some more
+		return c.Read(p)
+	}
+	return j, err
+}
+
+// cp1252 holds the characters that Windows-1252 puts in place of the C1
+// control codes 0x80-0x9F. The five unused codes are left as they are.
+var cp1252 = [32]rune{
+	'\u20ac', '\u0081', '\u201a', '\u0192', '\u201e', '\u2026', '\u2020', '\u2021',
+	'\u02c6', '\u2030', '\u0160', '\u2039', '\u0152', '\u008d', '\u017d', '\u008f',
+	'\u0090', '\u2018', '\u2019', '\u201c', '\u201d', '\u2022', '\u2013', '\u2014',
+	'\u02dc', '\u2122', '\u0161', '\u203a', '\u0153', '\u009d', '\u017e', '\u0178',
+}
+
+// decodeCharset() converts text to UTF-8. Only Latin-1 and Windows-1252 are
+// converted - UTF-8 and ASCII need no work, and anything else is passed
+// through as it is.
+func decodeCharset(charset string, data []byte) string {
+	switch strings.ToLower(charset) {
+	case "iso-8859-1", "latin1", "windows-1252", "cp1252":
+		windows := strings.HasSuffix(strings.ToLower(charset), "1252")
+		runes := make([]rune, len(data))
+		for i, b := range data {
+			runes[i] = rune(b)
+			if windows && b >= 0x80 && b <= 0x9f {
+				runes[i] = cp1252[b-0x80]
+			}
+		}
+		return string(runes)
+	}
+	return string(data)
+}
+
+// charsetReader() lets the header decoder handle the same character sets
+// as message bodies.
+func charsetReader(charset string, input io.Reader) (io.Reader, error) {
+	data, err := io.ReadAll(input)
+	if err != nil {
+		return nil, err
+	}
+	return strings.NewReader(decodeCharset(charset, data)), nil
+}
+
+// decodeHeaderText() decodes any RFC 2047 encoded words in a header.
+func decodeHeaderText(text string, dec *mime.WordDecoder) string {
+	decoded, err := dec.DecodeHeader(text)
+	if err != nil {
+		return text
+	}
+	return decoded
+}
+
+// parseAddressList() parses a header holding a list of addresses.
+func parseAddressList(header mail.Header, name string, dec *mime.WordDecoder) ([]*mail.Address, error) {
+	value := header.Get(name)
+	if len(value) == 0 {
+		return nil, nil
+	}
+	parser := &mail.AddressParser{WordDecoder: dec}
+	return parser.ParseList(value)
+}
+
+// addressStrings() parses a list of addresses into the strings used by
+// EmailHeader - 'Name <addr>' where there's a name, otherwise just the
+// address. If the list can't be parsed, it's split on commas.
+func addressStrings(header mail.Header, name string, dec *mime.WordDecoder) []string {
+	addrs, err := parseAddressList(header, name, dec)
+	if err != nil {
+		list := []string{}
+		for _, addr := range strings.Split(header.Get(name), ",") {
+			if addr = strings.TrimSpace(addr); len(addr) > 0 {
+				list = append(list, addr)
+			}
+		}
+		return list
+	}
+	if len(addrs) == 0 {
+		return nil
+	}
+	list := make([]string, len(addrs))
+	for i, addr := range addrs {
+		list[i] = addressString(addr)
+	}
+	return list
+}
+
+// addressString() converts a parsed address back to the 'Name <addr>' form,
+// quoting the name if it contains anything that would confuse a parser.
+func addressString(addr *mail.Address) string {
+	if len(addr.Name) == 0 {
+		return addr.Address
+	}
+	name := addr.Name
+	if strings.ContainsAny(name, "()<>[]:;@\\,.\"") {
+		name = "\"" + strings.NewReplacer("\\", "\\\\", "\"", "\\\"").Replace(name) + "\""
+	}
+	return name + " <" + addr.Address + ">"
+}
+
+// crlfText() makes sure all line endings in text are CRLF, as they are in
+// bodies built with BodySet() and BodyAppend().
+func crlfText(text string) string {
+	text = strings.ReplaceAll(text, "\r\n", "\n")
+	return strings.ReplaceAll(text, "\n", "\r\n")
+}
@@ -0,0 +1,274 @@
+/*
+Named email profiles for emailutils.
+
+A single config file describes a single mail server. Profiles allow several
+to be defined, so that mail can go out through a backup relay when the
+usual one is down. They can be loaded from a directory, in which case each
+*.cfg file is a profile named after the file:
+
+	/etc/email/primary.cfg
+	/etc/email/backup.cfg
+
+or from a single file, where each setting is prefixed with the name of the
+profile it belongs to. Settings without a prefix are shared by all
+profiles, and 'order' gives the order in which they're tried:
+
+	order=primary,backup
+	user=alerts@example.com
+	primary.host=mail.example.com
+	primary.pass=top_secret_password
+	backup.host=smtp.backup-relay.net
+	backup.port=2525
+	backup.pass=another_password
+
+Without 'order', profiles are tried in alphabetical order of name. Each
+profile is checked in the same way as ReadConfigFile().
+
+SendWithProfiles() tries each profile in turn until one of them works. The
+result says which profile delivered the message, and what went wrong with
+any that were tried before it. There's no failover if the message itself is
+at fault, or if some recipients have already received it.
+*/
+
+package emailutils
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/mspeculatrix/msgolib/fileutils"
+)
+
+// Profiles is a set of named email configs, along with the order in which
+// to try them.
+type Profiles struct {
+	Configs map[string]map[string]string
+	Order   []string
+}
+
+// ProfileError records the failure of a single profile.
+type ProfileError struct {
+	Profile string
+	Err     error
+}
+
+func (e ProfileError) Error() string {
+	return "profile " + e.Profile + ": " + e.Err.Error()
+}
+
+func (e ProfileError) Unwrap() error {
+	return e.Err
+}
+
+// SendResult reports how a message sent with SendWithProfiles() got on.
+type SendResult struct {
+	Profile string         // the profile that sent the message, if any
+	Failed  []ProfileError // profiles that were tried and failed, in order
+}
+
+// LoadProfiles() reads profiles from a directory of *.cfg files or from a
+// single file of prefixed settings.
+func LoadProfiles(path string) (*Profiles, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, fmt.Errorf("%w: Error reading email profiles: %v", ErrConfig, err)
+	}
+	p := &Profiles{Configs: map[string]map[string]string{}}
+	sources := map[string]string{} // file each profile came from
+	if info.IsDir() {
+		files, err := filepath.Glob(filepath.Join(path, "*.cfg"))
+		if err != nil {
+			return nil, fmt.Errorf("%w: Error reading email profiles: %v", ErrConfig, err)
+		}
+		for _, file := range files {
+			cfg, err := fileutils.ReadConfigFile(file)
+			if err != nil {
+				return nil, fmt.Errorf("%w: Error reading email profile: %v", ErrConfig, err)
+			}
+			name := strings.TrimSuffix(filepath.Base(file), ".cfg")
+			p.Configs[name] = cfg
+			sources[name] = file
+		}
+	} else {
+		entries, err := fileutils.ReadConfigEntries(path)
+		if err != nil {
+			return nil, fmt.Errorf("%w: Error reading email profiles: %v", ErrConfig, err)
+		}
+		if err = p.fromEntries(entries); err != nil {
+			return nil, err
+		}
+		for name := range p.Configs {
+			sources[name] = path
+		}
+	}
+	if len(p.Configs) == 0 {
+		return nil, fmt.Errorf("%w: No email profiles found in %s", ErrConfig, path)
+	}
+	// passwords may be kept elsewhere - see secrets.go
+	var errs ConfigErrors
+	for name, cfg := range p.Configs {
+		for _, ce := range append(checkConfigPerms(sources[name], cfg), resolveSecrets(cfg)...) {
+			ce.Key = name + "." + ce.Key
+			errs = append(errs, ce)
+		}
+	}
+	if len(errs) > 0 {
+		sort.Slice(errs, func(i, j int) bool { return errs[i].Key < errs[j].Key })
+		return nil, errs
+	}
+	if err = p.Check(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// fromEntries() sorts the settings from a profiles file into profiles.
+func (p *Profiles) fromEntries(entries []fileutils.ConfigEntry) error {
+	shared := map[string]string{}
+	for _, entry := range entries {
+		if entry.Key == "order" {
+			p.Order = nil
+			for _, name := range strings.Split(entry.Value, ",") {
+				if name = strings.TrimSpace(name); len(name) > 0 {
+					p.Order = append(p.Order, name)
+				}
+			}
+			continue
+		}
+		name, key, found := strings.Cut(entry.Key, ".")
+		if !found {
+			shared[entry.Key] = entry.Value
+			continue
+		}
+		if len(name) == 0 || len(key) == 0 {
+			return fmt.Errorf("%w: line %d: invalid setting '%s'", ErrConfig, entry.Line, entry.Key)
+		}
+		if p.Configs[name] == nil {
+			p.Configs[name] = map[string]string{}
+		}
+		p.Configs[name][key] = entry.Value
+	}
+	// a profile's own settings take precedence over shared ones - and a
+	// profile that gives a secret in any form doesn't inherit it in another
+	for _, cfg := range p.Configs {
+		own := map[string]bool{}
+		for key := range cfg {
+			if secret, ok := secretKey(key); ok {
+				own[secret] = true
+			}
+		}
+		for key, value := range shared {
+			if _, ok := cfg[key]; ok {
+				continue
+			}
+			if secret, ok := secretKey(key); ok && own[secret] {
+				continue
+			}
+			cfg[key] = value
+		}
+	}
+	return nil
+}
+
+// Check() makes sure every profile has the settings it needs and that the
+// order only names profiles that exist. If no order has been given, it's
+// set to all the profiles in alphabetical order.
+func (p *Profiles) Check() error {
+	var errs = []string{}
+	names := make([]string, 0, len(p.Configs))
+	for name := range p.Configs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		for _, e := range checkConfigMap(p.Configs[name]) {
+			errs = append(errs, "profile "+name+": "+e)
+		}
+	}
+	if len(p.Order) == 0 {
+		p.Order = names
+	}
+	for _, name := range p.Order {
+		if _, ok := p.Configs[name]; !ok {
+			errs = append(errs, "Unknown profile in order: "+name)
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("%w: %s", ErrConfig, strings.Join(errs[:], "; "))
+	}
+	return nil
+}
+
+// Profile() returns the config for the named profile.
+func (p *Profiles) Profile(name string) (map[string]string, bool) {
+	cfg, ok := p.Configs[name]
+	return cfg, ok
+}
+
+// SendWithProfiles() sends the message using each profile in turn until
+// one succeeds.
+func (msg EmailMessage) SendWithProfiles(p *Profiles) (SendResult, error) {
+	return msg.SendWithProfilesContext(context.Background(), p)
+}
+
+// SendWithProfilesContext() is SendWithProfiles() with a context, which
+// applies to the whole sequence of attempts.
+func (msg EmailMessage) SendWithProfilesContext(ctx context.Context, p *Profiles) (SendResult, error) {
+	var result SendResult
+	if err := msg.Header.CheckHeaders(); err != nil {
+		return result, err
+	}
+	order := p.Order
+	if len(order) == 0 {
+		if err := p.Check(); err != nil {
+			return result, err
+		}
+		order = p.Order
+	}
+	var err error
+	for _, name := range order {
+		cfg, ok := p.Configs[name]
+		if !ok {
+			err = fmt.Errorf("%w: Unknown profile: %s", ErrConfig, name)
+		} else {
+			err = msg.SendContext(ctx, cfg)
+		}
+		if err == nil {
+			result.Profile = name
+			return result, nil
+		}
+		result.Failed = append(result.Failed, ProfileError{Profile: name, Err: err})
+		if !failover(ctx, err) {
+			break
+		}
+	}
+	if len(result.Failed) == 0 {
+		return result, fmt.Errorf("%w: No email profiles", ErrConfig)
+	}
+	// the last failure is wrapped, so it can be examined with errors.Is()
+	msgs := []string{}
+	for _, pe := range result.Failed[:len(result.Failed)-1] {
+		msgs = append(msgs, pe.Error()+"; ")
+	}
+	return result, fmt.Errorf("Error sending email: %s%w", strings.Join(msgs, ""),
+		result.Failed[len(result.Failed)-1])
+}
+
+// failover() decides whether a failure means the next profile should be
+// tried.
+func failover(ctx context.Context, err error) bool {
+	if ctx.Err() != nil || errors.Is(err, ErrHeaders) {
+		return false
+	}
+	// don't risk sending the message twice
+	var se *SendError
+	if errors.As(err, &se) && se.Delivered {
+		return false
+	}
+	return true
+}
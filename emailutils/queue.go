@@ -0,0 +1,331 @@
+/*
+Persistent outbound queue for emailutils.
+
+Messages that are enqueued are rendered and written to disk straight away,
+then sent by a background worker. If sending fails, the message stays in the
+queue and is retried later, with the delay doubling after each attempt. Once
+a message has used up its attempts, or if the failure is known to be
+permanent (such as a 5xx rejection), it's moved to the dead-letter
+directory. If only some of the recipients were rejected, only those whose
+rejection was temporary are retried.
+
+The queue is configured with the same key=value config file conventions as
+everything else, and can simply share the email config file:
+
+	queue_dir=/var/spool/emailutils   # required
+	queue_max_attempts=8              # attempts before giving up
+	queue_retry_base=30s              # delay after the first failure
+	queue_retry_max=1h                # upper limit for the delay
+	queue_interval=15s                # how often the worker checks the queue
+
+Messages waiting to be sent are in queue_dir/pending and failures end up in
+queue_dir/dead.
+*/
+
+package emailutils
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	DefaultQueueMaxAttempts = 8
+	DefaultQueueRetryBase   = 30 * time.Second
+	DefaultQueueRetryMax    = time.Hour
+	DefaultQueueInterval    = 15 * time.Second
+)
+
+// Queue is a disk-backed queue of outgoing messages.
+type Queue struct {
+	Dir         string        // where queued messages are kept
+	MaxAttempts int           // attempts before a message is declared dead
+	RetryBase   time.Duration // delay after the first failed attempt
+	RetryMax    time.Duration // maximum delay between attempts
+	Interval    time.Duration // how often the worker checks the queue
+	Transport   Transport     // used to send the messages
+
+	mu   sync.Mutex // only one pass through the queue at a time
+	stop chan struct{}
+	done chan struct{}
+}
+
+// queueEntry is the on-disk form of a queued message.
+type queueEntry struct {
+	From        string    `json:"from"`
+	To          []string  `json:"to"`
+	Data        []byte    `json:"data"`
+	Queued      time.Time `json:"queued"`
+	Attempts    int       `json:"attempts"`
+	NextAttempt time.Time `json:"next_attempt"`
+	LastError   string    `json:"last_error,omitempty"`
+}
+
+// queueCounter helps make queue filenames unique within this process.
+var queueCounter uint64
+
+// NewQueue() creates a queue from the settings in a config map. Messages
+// are sent using the Transport selected by the same map.
+func NewQueue(cfg map[string]string) (*Queue, error) {
+	var errs = []string{}
+	q := &Queue{
+		Dir:         cfg["queue_dir"],
+		MaxAttempts: DefaultQueueMaxAttempts,
+		RetryBase:   DefaultQueueRetryBase,
+		RetryMax:    DefaultQueueRetryMax,
+		Interval:    DefaultQueueInterval,
+	}
+	if len(q.Dir) == 0 {
+		errs = append(errs, "Missing config value: queue_dir")
+	}
+	if v := cfg["queue_max_attempts"]; len(v) > 0 {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			errs = append(errs, "Invalid config value: queue_max_attempts")
+		}
+		q.MaxAttempts = n
+	}
+	durations := map[string]*time.Duration{
+		"queue_retry_base": &q.RetryBase,
+		"queue_retry_max":  &q.RetryMax,
+		"queue_interval":   &q.Interval,
+	}
+	for key, dest := range durations {
+		if v := cfg[key]; len(v) > 0 {
+			d, err := time.ParseDuration(v)
+			if err != nil || d <= 0 {
+				errs = append(errs, "Invalid config value: "+key)
+			}
+			*dest = d
+		}
+	}
+	if len(errs) > 0 {
+		sort.Strings(errs)
+		return nil, fmt.Errorf("%w: %s", ErrConfig, strings.Join(errs[:], "; "))
+	}
+	t, err := NewTransport(cfg)
+	if err != nil {
+		return nil, err
+	}
+	q.Transport = t
+	return q, nil
+}
+
+// Enqueue() renders a message and adds it to the queue. It will be sent the
+// next time the queue is processed.
+func (q *Queue) Enqueue(msg EmailMessage) error {
+	err := msg.Header.CheckHeaders()
+	if err != nil {
+		return err
+	}
+	if err = q.makeDirs(); err != nil {
+		return err
+	}
+	now := time.Now()
+	entry := queueEntry{
+		From:        msg.Header.From,
+		To:          msg.Header.Recipients(),
+		Data:        msg.Bytes(),
+		Queued:      now,
+		NextAttempt: now,
+	}
+	name := strconv.FormatInt(now.UnixNano(), 10) + "-" +
+		strconv.Itoa(os.Getpid()) + "-" +
+		strconv.FormatUint(atomic.AddUint64(&queueCounter, 1), 10) + ".json"
+	return writeQueueEntry(filepath.Join(q.Dir, "pending", name), entry)
+}
+
+// Process() makes one pass through the queue, attempting to send every
+// message that is due. It returns the number of messages sent and the
+// number that were moved to the dead-letter directory.
+func (q *Queue) Process() (sent int, dead int, err error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if err = q.makeDirs(); err != nil {
+		return sent, dead, err
+	}
+	files, err := filepath.Glob(filepath.Join(q.Dir, "pending", "*.json"))
+	if err != nil {
+		return sent, dead, err
+	}
+	sort.Strings(files) // oldest first
+	now := time.Now()
+	for _, path := range files {
+		entry, err := readQueueEntry(path)
+		if err != nil {
+			// can't be parsed, so it will never be sent
+			os.Rename(path, filepath.Join(q.Dir, "dead", filepath.Base(path)))
+			dead++
+			continue
+		}
+		if entry.NextAttempt.After(now) {
+			continue
+		}
+		entry.Attempts++
+		sendErr := q.Transport.Send(entry.From, entry.To, entry.Data)
+		if sendErr == nil {
+			os.Remove(path)
+			sent++
+			continue
+		}
+		entry.LastError = sendErr.Error()
+		var se *SendError
+		if errors.As(sendErr, &se) && se.Delivered {
+			// some recipients got it - only retry those that might yet
+			retry := []string{}
+			for _, re := range se.Recipients {
+				if re.Temporary() {
+					retry = append(retry, re.Address)
+				}
+			}
+			if len(retry) == 0 {
+				os.Remove(path)
+				sent++
+				continue
+			}
+			entry.To = retry
+		}
+		if entry.Attempts >= q.MaxAttempts || isPermanent(sendErr) {
+			target := filepath.Join(q.Dir, "dead", filepath.Base(path))
+			if err = writeQueueEntry(target, entry); err == nil {
+				os.Remove(path)
+			}
+			dead++
+			continue
+		}
+		entry.NextAttempt = now.Add(q.backoff(entry.Attempts))
+		writeQueueEntry(path, entry)
+	}
+	return sent, dead, nil
+}
+
+// Len() returns the number of messages waiting to be sent.
+func (q *Queue) Len() int {
+	files, _ := filepath.Glob(filepath.Join(q.Dir, "pending", "*.json"))
+	return len(files)
+}
+
+// Start() launches a background worker that processes the queue every
+// Interval until Stop() is called.
+func (q *Queue) Start() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.stop != nil {
+		return // already running
+	}
+	q.stop = make(chan struct{})
+	q.done = make(chan struct{})
+	go q.worker(q.stop, q.done)
+}
+
+// Stop() halts the background worker, waiting for any pass through the
+// queue that's in progress to finish.
+func (q *Queue) Stop() {
+	q.mu.Lock()
+	stop, done := q.stop, q.done
+	q.stop, q.done = nil, nil
+	q.mu.Unlock()
+	if stop != nil {
+		close(stop)
+		<-done
+	}
+}
+
+// worker() is the background goroutine started by Start().
+func (q *Queue) worker(stop chan struct{}, done chan struct{}) {
+	defer close(done)
+	ticker := time.NewTicker(q.Interval)
+	defer ticker.Stop()
+	for {
+		q.Process()
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// isPermanent() checks whether a failure is certain to happen again, so
+// there's no point retrying. Errors that can't be classified - from a
+// Transport other than SMTP, say - are given the benefit of the doubt.
+func isPermanent(err error) bool {
+	var se *SendError
+	if errors.As(err, &se) {
+		return !se.Temporary()
+	}
+	return errors.Is(err, ErrConfig) || errors.Is(err, ErrHeaders)
+}
+
+// backoff() calculates the delay before the next attempt, doubling with each
+// failed attempt up to RetryMax.
+func (q *Queue) backoff(attempts int) time.Duration {
+	delay := q.RetryBase
+	for i := 1; i < attempts; i++ {
+		delay *= 2
+		if delay >= q.RetryMax {
+			return q.RetryMax
+		}
+	}
+	return delay
+}
+
+// makeDirs() ensures the queue directories exist.
+func (q *Queue) makeDirs() error {
+	if len(q.Dir) == 0 {
+		return errors.New("No queue directory set")
+	}
+	for _, sub := range []string{"pending", "dead"} {
+		if err := os.MkdirAll(filepath.Join(q.Dir, sub), 0750); err != nil {
+			return fmt.Errorf("Error creating queue directory: %v", err)
+		}
+	}
+	return nil
+}
+
+// readQueueEntry() loads a queued message from disk.
+func readQueueEntry(path string) (queueEntry, error) {
+	var entry queueEntry
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return entry, err
+	}
+	err = json.Unmarshal(data, &entry)
+	return entry, err
+}
+
+// writeQueueEntry() saves a queued message to disk. It's written to a
+// temporary file first so that a crash never leaves a half-written entry.
+func writeQueueEntry(path string, entry queueEntry) error {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	tmpPath := path + ".tmp"
+	fh, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0640)
+	if err != nil {
+		return fmt.Errorf("Error writing queue file: %v", err)
+	}
+	_, err = fh.Write(data)
+	if err == nil {
+		err = fh.Sync()
+	}
+	fh.Close()
+	if err == nil {
+		err = os.Rename(tmpPath, path)
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("Error writing queue file: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,251 @@
+/*
+Password handling for emailutils.
+
+Rather than putting the password in the config file with 'pass', it can be
+fetched from somewhere else:
+
+	pass_file=/etc/email/smtp.pass   read from a file, which must not be
+	                                 readable by group or others
+	pass_env=SMTP_PASS               read from an environment variable
+	pass_enc=<encrypted password>    decrypted with the key in key_file
+	key_file=/etc/email/email.key
+
+The same goes for 'token' (token_file, token_env, token_enc) and 'in_pass'.
+Only one source may be given for each. Key files must not be readable by
+group or others either. To set up an encrypted password:
+
+	err := emailutils.GenerateKeyFile("/etc/email/email.key")
+	enc, err := emailutils.EncryptPassword("/etc/email/email.key", "secret")
+	// put 'pass_enc=' + enc and 'key_file=/etc/email/email.key' in the config
+
+A config file that contains a password or token in plain text is refused if
+it's world-readable.
+
+Passwords are encrypted with AES-256-GCM, which keeps them out of the config
+file but is only as safe as the key file.
+*/
+
+package emailutils
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/mspeculatrix/msgolib/fileutils"
+)
+
+// secretKeys are the settings that may be given indirectly.
+var secretKeys = []string{"pass", "token", "in_pass"}
+
+// secretKey() checks whether a setting gives one of the secretKeys, either
+// directly or indirectly, and if so returns which one.
+func secretKey(key string) (string, bool) {
+	for _, secret := range secretKeys {
+		for _, suffix := range []string{"", "_file", "_env", "_enc"} {
+			if key == secret+suffix {
+				return secret, true
+			}
+		}
+	}
+	return "", false
+}
+
+// resolveSecrets() replaces any indirect secrets in a config map
+// (pass_file, pass_env, pass_enc and so on) with the values they point to.
+func resolveSecrets(cfg map[string]string) ConfigErrors {
+	var errs ConfigErrors
+	for _, key := range secretKeys {
+		sources := []string{}
+		for _, k := range []string{key, key + "_file", key + "_env", key + "_enc"} {
+			if _, ok := cfg[k]; ok {
+				sources = append(sources, k)
+			}
+		}
+		if len(sources) == 0 {
+			continue
+		}
+		if len(sources) > 1 {
+			errs = append(errs, ConfigError{Key: sources[1],
+				Msg: "only one of " + strings.Join(sources, ", ") + " may be given"})
+			continue
+		}
+		var value string
+		var err error
+		switch src := sources[0]; src {
+		case key:
+			continue
+		case key + "_file":
+			value, err = readSecretFile(cfg[src])
+		case key + "_env":
+			var ok bool
+			value, ok = os.LookupEnv(cfg[src])
+			if !ok || len(value) == 0 {
+				err = errors.New("environment variable " + cfg[src] + " not set")
+			}
+		case key + "_enc":
+			value, err = decryptPassword(cfg["key_file"], cfg[src])
+		}
+		if err != nil {
+			errs = append(errs, ConfigError{Key: sources[0], Msg: err.Error()})
+			continue
+		}
+		delete(cfg, sources[0])
+		cfg[key] = value
+	}
+	return errs
+}
+
+// checkConfigPerms() makes sure a config file holding plain-text secrets
+// can't be read by everyone.
+func checkConfigPerms(cfgFile string, cfg map[string]string) ConfigErrors {
+	var errs ConfigErrors
+	info, err := os.Stat(cfgFile)
+	if err != nil || info.Mode().Perm()&0004 == 0 {
+		return errs
+	}
+	for _, key := range secretKeys {
+		if len(cfg[key]) > 0 {
+			errs = append(errs, ConfigError{Key: key, Msg: "config file " + cfgFile +
+				" is world-readable - use chmod o-r or one of the indirect settings"})
+		}
+	}
+	return errs
+}
+
+// secretEntries() resolves indirect secrets in a list of config entries.
+// Each indirect setting is replaced with the setting it provides, on the
+// same line.
+func secretEntries(entries []fileutils.ConfigEntry) ([]fileutils.ConfigEntry, ConfigErrors) {
+	cfg := map[string]string{}
+	lines := map[string]int{}
+	for _, entry := range entries {
+		cfg[entry.Key] = entry.Value
+		lines[entry.Key] = entry.Line
+	}
+	errs := resolveSecrets(cfg)
+	for i := range errs {
+		errs[i].Line = lines[errs[i].Key]
+	}
+	resolved := []fileutils.ConfigEntry{}
+	for _, entry := range entries {
+		if _, ok := cfg[entry.Key]; !ok {
+			// an indirect setting that has been resolved
+			entry.Key = entry.Key[:strings.LastIndex(entry.Key, "_")]
+			entry.Value = cfg[entry.Key]
+		}
+		resolved = append(resolved, entry)
+	}
+	return resolved, errs
+}
+
+// readSecretFile() reads a secret from a file that only its owner can read.
+// Leading and trailing whitespace, such as the final newline, is removed.
+func readSecretFile(path string) (string, error) {
+	data, err := readPrivateFile(path)
+	if err != nil {
+		return "", err
+	}
+	secret := strings.TrimSpace(string(data))
+	if len(secret) == 0 {
+		return "", errors.New(path + " is empty")
+	}
+	return secret, nil
+}
+
+// readPrivateFile() reads a file, refusing if group or others can read it.
+func readPrivateFile(path string) ([]byte, error) {
+	if len(path) == 0 {
+		return nil, errors.New("no file given")
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if info.Mode().Perm()&0077 != 0 {
+		return nil, fmt.Errorf("%s has permissions %v - must not be accessible by group or others",
+			path, info.Mode().Perm())
+	}
+	return os.ReadFile(path)
+}
+
+// GenerateKeyFile() creates a new random key for encrypting passwords. The
+// file is created with permissions 0600 and must not already exist.
+func GenerateKeyFile(path string) error {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return fmt.Errorf("Error generating key: %v", err)
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return fmt.Errorf("Error creating key file: %v", err)
+	}
+	_, err = f.WriteString(hex.EncodeToString(key) + "\n")
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return fmt.Errorf("Error writing key file: %v", err)
+	}
+	return nil
+}
+
+// EncryptPassword() encrypts a password with the key in keyFile, returning
+// the value to use for pass_enc.
+func EncryptPassword(keyFile string, password string) (string, error) {
+	aead, err := passwordCipher(keyFile)
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err = rand.Read(nonce); err != nil {
+		return "", fmt.Errorf("Error generating nonce: %v", err)
+	}
+	sealed := aead.Seal(nonce, nonce, []byte(password), nil)
+	return base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// decryptPassword() reverses EncryptPassword().
+func decryptPassword(keyFile string, enc string) (string, error) {
+	aead, err := passwordCipher(keyFile)
+	if err != nil {
+		return "", err
+	}
+	sealed, err := base64.StdEncoding.DecodeString(strings.TrimSpace(enc))
+	if err != nil || len(sealed) < aead.NonceSize() {
+		return "", errors.New("encrypted password is malformed")
+	}
+	nonce, ciphertext := sealed[:aead.NonceSize()], sealed[aead.NonceSize():]
+	plain, err := aead.Open(nil, nonce, ciphertext, nil)
+	if err != nil {
+		return "", errors.New("can't decrypt password - wrong key file?")
+	}
+	return string(plain), nil
+}
+
+// passwordCipher() sets up AES-256-GCM with the key in keyFile, which holds
+// 32 bytes written as hex.
+func passwordCipher(keyFile string) (cipher.AEAD, error) {
+	if len(keyFile) == 0 {
+		return nil, errors.New("key_file not given")
+	}
+	data, err := readPrivateFile(keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading key file: %v", err)
+	}
+	key, err := hex.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil || len(key) != 32 {
+		return nil, errors.New("key file " + keyFile + " must hold 32 bytes in hex")
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,339 @@
+/*
+SMTP delivery for emailutils.
+
+Both ways of connecting - implicit TLS (use_tls=yes, usually port 465) and
+plain connections upgraded with STARTTLS (usually port 587) - share the same
+session: connect, authenticate once, then one MAIL FROM, one RCPT TO for each
+recipient and a single DATA carrying the full rendered message.
+
+Server certificates are verified. The following optional config keys change
+that behaviour:
+
+	tls_ca_file=/path/to/ca.pem    trust the CA certificate(s) in this file
+	tls_server_name=mail.example   name expected in the certificate, if it
+	                               differs from 'host'
+	tls_insecure=yes               don't verify certificates at all
+
+The connection mode can also be set with 'tls_mode' (none, starttls or
+implicit), which overrides use_tls, and time limits set with
+'dial_timeout', 'command_timeout' and 'timeout' - see config.go.
+
+SendContext() allows sending to be cancelled at any point. Failures are
+reported as a *SendError, which says which stage of the session failed.
+*/
+
+package emailutils
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"net/smtp"
+	"os"
+	"strings"
+	"time"
+)
+
+// tlsConfig() creates the TLS settings for a connection from the config map.
+func tlsConfig(cfg map[string]string) (*tls.Config, error) {
+	insecure, _ := parseBool(cfg["tls_insecure"])
+	tlsCfg := &tls.Config{
+		ServerName:         cfg["host"],
+		InsecureSkipVerify: insecure,
+	}
+	if len(cfg["tls_server_name"]) > 0 {
+		tlsCfg.ServerName = cfg["tls_server_name"]
+	}
+	if len(cfg["tls_ca_file"]) > 0 {
+		pem, err := os.ReadFile(cfg["tls_ca_file"])
+		if err != nil {
+			return nil, fmt.Errorf("Error reading CA file: %v", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, errors.New("No certificates found in CA file " + cfg["tls_ca_file"])
+		}
+		tlsCfg.RootCAs = pool
+	}
+	return tlsCfg, nil
+}
+
+// Stage identifies the part of an SMTP session in which something failed.
+type Stage string
+
+const (
+	StageDial Stage = "dial" // connecting, including TLS set-up
+	StageAuth Stage = "auth"
+	StageMail Stage = "mail" // MAIL FROM
+	StageRcpt Stage = "rcpt" // RCPT TO
+	StageData Stage = "data" // sending the message itself
+)
+
+// SendError is returned when an SMTP session fails. It records the stage
+// that failed along with the underlying error - which will be
+// context.Canceled or context.DeadlineExceeded if the context ended.
+//
+// If some recipients were rejected but others accepted, the message is still
+// sent to those that were accepted. In that case Stage is StageRcpt,
+// Recipients lists the rejections and Delivered is true.
+type SendError struct {
+	Stage      Stage
+	Code       int // SMTP reply code, or 0 if the server didn't send one
+	Err        error
+	Recipients []*RecipientError
+	Delivered  bool // the message went to the recipients that were accepted
+}
+
+func (e *SendError) Error() string {
+	return "SMTP " + string(e.Stage) + " failed: " + e.Err.Error()
+}
+
+func (e *SendError) Unwrap() error {
+	return e.Err
+}
+
+// smtpSession is a connected and authenticated SMTP client.
+type smtpSession struct {
+	conn       net.Conn
+	client     *smtp.Client
+	cmdTimeout time.Duration
+	stop       chan struct{} // ends the cancellation watcher
+}
+
+// dialSMTP() connects to the server described by the config map and returns
+// a session that has been secured with TLS (where possible) and
+// authenticated. If the context is cancelled, whatever the session is doing
+// at the time is aborted.
+func dialSMTP(ctx context.Context, cfg map[string]string) (*smtpSession, error) {
+	return dialSMTPSession(ctx, ctx, cfg)
+}
+
+// dialSMTPSession() works like dialSMTP(), except that connecting is
+// limited by ctx while the session is only aborted when sessionCtx ends -
+// so a session can be reused after the context it was set up with is over.
+func dialSMTPSession(ctx context.Context, sessionCtx context.Context, cfg map[string]string) (*smtpSession, error) {
+	dialTimeout, err := configDuration(cfg, "dial_timeout")
+	if err != nil {
+		return nil, err
+	}
+	cmdTimeout, err := configDuration(cfg, "command_timeout")
+	if err != nil {
+		return nil, err
+	}
+	tlsCfg, err := tlsConfig(cfg)
+	if err != nil {
+		return nil, newSendError(StageDial, err)
+	}
+	addr := net.JoinHostPort(cfg["host"], cfg["port"])
+	dialer := &net.Dialer{Timeout: dialTimeout}
+	var conn net.Conn
+	mode := smtpTLSMode(cfg)
+	if mode == TLSImplicit {
+		tlsDialer := &tls.Dialer{NetDialer: dialer, Config: tlsCfg}
+		conn, err = tlsDialer.DialContext(ctx, "tcp", addr)
+	} else {
+		conn, err = dialer.DialContext(ctx, "tcp", addr)
+	}
+	if err != nil {
+		return nil, newSendError(StageDial, err)
+	}
+	s := &smtpSession{conn: conn, cmdTimeout: cmdTimeout, stop: make(chan struct{})}
+	go func() {
+		select {
+		case <-sessionCtx.Done():
+			// unblock anything waiting on the connection
+			conn.SetDeadline(time.Unix(1, 0))
+		case <-s.stop:
+		}
+	}()
+	err = s.do(ctx, StageDial, func() error {
+		// reads the server's greeting and sends EHLO
+		c, err := smtp.NewClient(conn, cfg["host"])
+		if err != nil {
+			return err
+		}
+		s.client = c
+		if mode == TLSStartTLS {
+			if ok, _ := c.Extension("STARTTLS"); ok {
+				return c.StartTLS(tlsCfg)
+			}
+		}
+		return nil
+	})
+	if err == nil {
+		err = s.do(ctx, StageAuth, func() error {
+			auth, err := smtpAuth(s.client, cfg)
+			if err != nil || auth == nil {
+				return err
+			}
+			return s.client.Auth(auth)
+		})
+	}
+	if err != nil {
+		s.close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// do() runs one stage of the session, applying the command timeout and
+// turning any failure into a SendError.
+func (s *smtpSession) do(ctx context.Context, stage Stage, fn func() error) error {
+	if err := ctx.Err(); err != nil {
+		return newSendError(stage, err)
+	}
+	var deadline time.Time
+	if s.cmdTimeout > 0 {
+		deadline = time.Now().Add(s.cmdTimeout)
+	}
+	if d, ok := ctx.Deadline(); ok && (deadline.IsZero() || d.Before(deadline)) {
+		deadline = d
+	}
+	s.conn.SetDeadline(deadline)
+	// if the context ended just before SetDeadline(), the watcher's past
+	// deadline has been overwritten, so check again
+	if err := ctx.Err(); err != nil {
+		return newSendError(stage, err)
+	}
+	if err := fn(); err != nil {
+		if ctx.Err() != nil {
+			// the failure was caused by the context ending
+			err = ctx.Err()
+		}
+		return newSendError(stage, err)
+	}
+	return nil
+}
+
+// send() delivers a rendered message to the given recipients.
+func (s *smtpSession) send(ctx context.Context, from string, rcpts []string, data []byte) error {
+	err := s.do(ctx, StageMail, func() error {
+		return s.client.Mail(envelopeAddress(from))
+	})
+	if err != nil {
+		return err
+	}
+	// try every recipient, so that all the rejections can be reported
+	rejected := []*RecipientError{}
+	for _, rcpt := range rcpts {
+		err = s.do(ctx, StageRcpt, func() error {
+			return s.client.Rcpt(envelopeAddress(rcpt))
+		})
+		if err != nil {
+			se := err.(*SendError)
+			if se.Code == 0 {
+				// not a rejection - the session itself has failed
+				return err
+			}
+			rejected = append(rejected, newRecipientError(rcpt, se.Err))
+		}
+	}
+	if len(rejected) > 0 {
+		rcptErr := &SendError{
+			Stage:      StageRcpt,
+			Code:       rejected[0].Code,
+			Err:        recipientsError(rejected),
+			Recipients: rejected,
+		}
+		if len(rejected) == len(rcpts) {
+			return rcptErr
+		}
+		if err = s.sendData(ctx, data); err != nil {
+			return err
+		}
+		rcptErr.Delivered = true
+		return rcptErr
+	}
+	return s.sendData(ctx, data)
+}
+
+// sendData() sends the message itself, once the recipients are set.
+func (s *smtpSession) sendData(ctx context.Context, data []byte) error {
+	return s.do(ctx, StageData, func() error {
+		w, err := s.client.Data()
+		if err != nil {
+			return err
+		}
+		if _, err = w.Write(data); err != nil {
+			w.Close()
+			return err
+		}
+		return w.Close()
+	})
+}
+
+// reset() abandons the current transaction with RSET, so that the session
+// can be used for another message.
+func (s *smtpSession) reset(ctx context.Context) error {
+	return s.do(ctx, StageMail, func() error {
+		return s.client.Reset()
+	})
+}
+
+// close() ends the session, saying goodbye politely if possible.
+func (s *smtpSession) close() {
+	if s.client != nil {
+		s.conn.SetDeadline(time.Now().Add(time.Second))
+		s.client.Quit()
+		s.client.Close()
+	} else {
+		s.conn.Close()
+	}
+	close(s.stop)
+}
+
+// configDuration() reads one of the time limits from the config map. A
+// missing value means no limit; one that isn't a valid duration is an
+// ErrConfig error rather than being quietly ignored.
+func configDuration(cfg map[string]string, key string) (time.Duration, error) {
+	v := cfg[key]
+	if len(v) == 0 {
+		return 0, nil
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d < 0 {
+		return 0, fmt.Errorf("%w: Invalid config value: %s", ErrConfig, key)
+	}
+	return d, nil
+}
+
+// smtpTLSMode() works out how the connection should be secured. The
+// 'tls_mode' key takes precedence over the older 'use_tls'.
+func smtpTLSMode(cfg map[string]string) string {
+	switch strings.ToLower(cfg["tls_mode"]) {
+	case TLSNone:
+		return TLSNone
+	case TLSImplicit:
+		return TLSImplicit
+	case TLSStartTLS:
+		return TLSStartTLS
+	}
+	if useTLS, _ := parseBool(cfg["use_tls"]); useTLS {
+		return TLSImplicit
+	}
+	return TLSStartTLS
+}
+
+// sendSMTP() delivers a rendered message to the given recipients in a
+// single session. The 'timeout' config key limits the time allowed for the
+// whole session.
+func sendSMTP(ctx context.Context, cfg map[string]string, from string, rcpts []string, data []byte) error {
+	d, err := configDuration(cfg, "timeout")
+	if err != nil {
+		return err
+	}
+	if d > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, d)
+		defer cancel()
+	}
+	s, err := dialSMTP(ctx, cfg)
+	if err != nil {
+		return err
+	}
+	defer s.close()
+	return s.send(ctx, from, rcpts, data)
+}
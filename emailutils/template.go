@@ -0,0 +1,139 @@
+/*
+Templates for emailutils.
+
+Rather than building a message with repeated BodyAppend() calls, the subject,
+plain-text body, HTML body and signature can each come from a template file.
+The subject, text and signature use text/template; the HTML body uses
+html/template so that data is escaped properly. For example:
+
+	tmpl, err := emailutils.LoadTemplates("alert.subject", "alert.txt", "alert.html")
+	err = tmpl.LoadSignature("sig.txt")
+	...
+	err = tmpl.Render(&email, alertData)
+
+Any of the file names can be left empty if that part isn't wanted.
+*/
+
+package emailutils
+
+import (
+	"bytes"
+	"fmt"
+	htemplate "html/template"
+	"os"
+	"path/filepath"
+	"strings"
+	ttemplate "text/template"
+)
+
+// EmailTemplate holds the templates used to build a message. Any of them
+// can be nil.
+type EmailTemplate struct {
+	Subject   *ttemplate.Template
+	Text      *ttemplate.Template
+	HTML      *htemplate.Template
+	Signature *ttemplate.Template
+}
+
+// LoadTemplates() reads and parses the subject, plain-text and HTML template
+// files. Pass an empty string for any that aren't needed.
+func LoadTemplates(subjectFile string, textFile string, htmlFile string) (*EmailTemplate, error) {
+	var err error
+	t := &EmailTemplate{}
+	if len(subjectFile) > 0 {
+		if t.Subject, err = loadTextTemplate(subjectFile); err != nil {
+			return nil, err
+		}
+	}
+	if len(textFile) > 0 {
+		if t.Text, err = loadTextTemplate(textFile); err != nil {
+			return nil, err
+		}
+	}
+	if len(htmlFile) > 0 {
+		src, err := os.ReadFile(htmlFile)
+		if err != nil {
+			return nil, fmt.Errorf("Error reading template: %v", err)
+		}
+		t.HTML, err = htemplate.New(filepath.Base(htmlFile)).Parse(string(src))
+		if err != nil {
+			return nil, fmt.Errorf("Error parsing template: %v", err)
+		}
+	}
+	return t, nil
+}
+
+// LoadSignature() reads and parses a template file for the signature.
+func (t *EmailTemplate) LoadSignature(sigFile string) error {
+	sig, err := loadTextTemplate(sigFile)
+	if err != nil {
+		return err
+	}
+	t.Signature = sig
+	return nil
+}
+
+// Render() executes the templates with the given data and puts the results
+// into the message, replacing any existing subject and bodies. The signature,
+// if there is one, is added to the end of the plain-text body.
+func (t *EmailTemplate) Render(msg *EmailMessage, data interface{}) error {
+	if t.Subject != nil {
+		subject, err := executeText(t.Subject, data)
+		if err != nil {
+			return err
+		}
+		// a subject must be a single line
+		msg.SetSubject(strings.Join(strings.Fields(subject), " "))
+	}
+	if t.Text != nil {
+		text, err := executeText(t.Text, data)
+		if err != nil {
+			return err
+		}
+		msg.BodySet(strings.TrimRight(text, "\r\n"))
+	}
+	if t.HTML != nil {
+		var buf bytes.Buffer
+		if err := t.HTML.Execute(&buf, data); err != nil {
+			return fmt.Errorf("Error executing template: %v", err)
+		}
+		msg.HTMLSet(strings.TrimRight(buf.String(), "\r\n"))
+	}
+	if t.Signature != nil {
+		return msg.AddSignatureTemplate(t.Signature, data)
+	}
+	return nil
+}
+
+// AddSignatureTemplate() works like AddSignature(), but the signature is
+// produced by executing a template with the given data.
+func (e *EmailMessage) AddSignatureTemplate(tmpl *ttemplate.Template, data interface{}) error {
+	sig, err := executeText(tmpl, data)
+	if err != nil {
+		return err
+	}
+	e.AddSignature(strings.TrimRight(sig, "\r\n"))
+	return nil
+}
+
+// loadTextTemplate() reads and parses a text/template file.
+func loadTextTemplate(file string) (*ttemplate.Template, error) {
+	src, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading template: %v", err)
+	}
+	tmpl, err := ttemplate.New(filepath.Base(file)).Parse(string(src))
+	if err != nil {
+		return nil, fmt.Errorf("Error parsing template: %v", err)
+	}
+	return tmpl, nil
+}
+
+// executeText() runs a text/template and returns the result as a string.
+func executeText(tmpl *ttemplate.Template, data interface{}) (string, error) {
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, data); err != nil {
+		return "", fmt.Errorf("Error executing template: %v", err)
+	}
+	return buf.String(), nil
+}
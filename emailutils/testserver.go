@@ -0,0 +1,397 @@
+/*
+A local SMTP server for testing emailutils.
+
+TestServer listens on a loopback port and accepts mail just like a real
+server, except that messages are kept in memory instead of being delivered.
+This allows alerting code to be tested end to end, including TLS and
+authentication, without a real mail server:
+
+	srv, err := emailutils.NewTestServer(false) // true for implicit TLS
+	if err != nil { ... }
+	defer srv.Close()
+	cfg := srv.Config() // host, port, user, pass, use_tls, tls_ca_file
+	err = msg.SendEmail(cfg)
+	received := srv.Messages()
+
+The server supports STARTTLS (unless it's using implicit TLS), and AUTH PLAIN
+and LOGIN. Either way, TLS uses a self-signed certificate generated when the
+server starts, which Config() tells the client to trust with 'tls_ca_file'.
+*/
+
+package emailutils
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net"
+	"net/textproto"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ReceivedMessage is a message accepted by a TestServer.
+type ReceivedMessage struct {
+	From    string       // envelope sender (MAIL FROM)
+	To      []string     // envelope recipients (RCPT TO)
+	Data    []byte       // the message exactly as sent
+	Message EmailMessage // the message parsed with ParseMessage()
+	User    string       // the user that authenticated, if any
+	TLS     bool         // whether the session was encrypted
+}
+
+// TestServer is an SMTP server for use in tests.
+type TestServer struct {
+	Host        string
+	Port        string
+	User        string // credentials clients must use - see Config()
+	Pass        string
+	ImplicitTLS bool   // TLS from the start, rather than STARTTLS
+	CAFile      string // PEM file holding the server's certificate
+
+	ln       net.Listener
+	tlsCfg   *tls.Config
+	mu       sync.Mutex
+	messages []ReceivedMessage
+	conns    map[net.Conn]bool
+	wg       sync.WaitGroup
+}
+
+// NewTestServer() starts a TestServer on a free loopback port. With
+// implicitTLS, connections use TLS from the start (like port 465);
+// otherwise they start in plain text and can be upgraded with STARTTLS
+// (like port 587).
+func NewTestServer(implicitTLS bool) (*TestServer, error) {
+	cert, certPEM, err := testCertificate()
+	if err != nil {
+		return nil, err
+	}
+	caFile, err := os.CreateTemp("", "emailutils-ca-*.pem")
+	if err != nil {
+		return nil, fmt.Errorf("Error creating CA file: %v", err)
+	}
+	_, err = caFile.Write(certPEM)
+	caFile.Close()
+	if err != nil {
+		os.Remove(caFile.Name())
+		return nil, fmt.Errorf("Error writing CA file: %v", err)
+	}
+	srv := &TestServer{
+		User:        "test@localhost",
+		Pass:        "test-password",
+		ImplicitTLS: implicitTLS,
+		CAFile:      caFile.Name(),
+		tlsCfg:      &tls.Config{Certificates: []tls.Certificate{cert}},
+		conns:       map[net.Conn]bool{},
+	}
+	srv.ln, err = net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		os.Remove(srv.CAFile)
+		return nil, fmt.Errorf("Error starting test server: %v", err)
+	}
+	if implicitTLS {
+		srv.ln = tls.NewListener(srv.ln, srv.tlsCfg)
+	}
+	srv.Host, srv.Port, _ = net.SplitHostPort(srv.ln.Addr().String())
+	srv.wg.Add(1)
+	go srv.serve()
+	return srv, nil
+}
+
+// Config() returns a config map for sending email through the server.
+func (srv *TestServer) Config() map[string]string {
+	cfg := map[string]string{
+		"host":        srv.Host,
+		"port":        srv.Port,
+		"user":        srv.User,
+		"pass":        srv.Pass,
+		"use_tls":     "no",
+		"tls_ca_file": srv.CAFile,
+	}
+	if srv.ImplicitTLS {
+		cfg["use_tls"] = "yes"
+	}
+	return cfg
+}
+
+// Messages() returns the messages the server has received so far.
+func (srv *TestServer) Messages() []ReceivedMessage {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	return append([]ReceivedMessage{}, srv.messages...)
+}
+
+// Reset() forgets all received messages.
+func (srv *TestServer) Reset() {
+	srv.mu.Lock()
+	srv.messages = nil
+	srv.mu.Unlock()
+}
+
+// Close() shuts the server down, dropping any open connections, and
+// removes the CA file.
+func (srv *TestServer) Close() error {
+	err := srv.ln.Close()
+	srv.mu.Lock()
+	for conn := range srv.conns {
+		conn.Close()
+	}
+	srv.mu.Unlock()
+	srv.wg.Wait()
+	os.Remove(srv.CAFile)
+	return err
+}
+
+// serve() accepts connections until the listener is closed.
+func (srv *TestServer) serve() {
+	defer srv.wg.Done()
+	for {
+		conn, err := srv.ln.Accept()
+		if err != nil {
+			return
+		}
+		srv.mu.Lock()
+		srv.conns[conn] = true
+		srv.mu.Unlock()
+		srv.wg.Add(1)
+		go func() {
+			defer srv.wg.Done()
+			srv.session(conn)
+			srv.mu.Lock()
+			delete(srv.conns, conn)
+			srv.mu.Unlock()
+			conn.Close()
+		}()
+	}
+}
+
+// smtpState is the state of a single SMTP session.
+type smtpState struct {
+	tp     *textproto.Conn
+	isTLS  bool
+	user   string
+	from   string
+	rcpts  []string
+	inMail bool
+}
+
+// reply() sends an SMTP reply, which may be several lines long.
+func (st *smtpState) reply(code int, lines ...string) {
+	for i, line := range lines {
+		sep := "-"
+		if i == len(lines)-1 {
+			sep = " "
+		}
+		st.tp.PrintfLine("%d%s%s", code, sep, line)
+	}
+}
+
+// session() handles one client connection.
+func (srv *TestServer) session(conn net.Conn) {
+	st := &smtpState{tp: textproto.NewConn(conn), isTLS: srv.ImplicitTLS}
+	st.reply(220, "localhost ESMTP emailutils test server")
+	for {
+		conn.SetDeadline(time.Now().Add(time.Minute))
+		line, err := st.tp.ReadLine()
+		if err != nil {
+			return
+		}
+		verb, arg := line, ""
+		if i := strings.IndexByte(line, ' '); i >= 0 {
+			verb, arg = line[:i], strings.TrimSpace(line[i+1:])
+		}
+		switch strings.ToUpper(verb) {
+		case "EHLO":
+			ext := []string{"localhost", "8BITMIME", "AUTH PLAIN LOGIN"}
+			if !st.isTLS {
+				ext = append(ext, "STARTTLS")
+			}
+			st.reply(250, ext...)
+		case "HELO":
+			st.reply(250, "localhost")
+		case "STARTTLS":
+			if st.isTLS {
+				st.reply(503, "Already using TLS")
+				continue
+			}
+			st.reply(220, "Ready to start TLS")
+			tlsConn := tls.Server(conn, srv.tlsCfg)
+			if err = tlsConn.Handshake(); err != nil {
+				return
+			}
+			// the session starts again from scratch. Close() still
+			// works, as closing the plain connection stops this one too
+			conn = tlsConn
+			st = &smtpState{tp: textproto.NewConn(conn), isTLS: true}
+		case "AUTH":
+			srv.auth(st, arg)
+		case "MAIL":
+			if len(srv.User) > 0 && len(st.user) == 0 {
+				st.reply(530, "Authentication required")
+				continue
+			}
+			st.from, st.rcpts, st.inMail = smtpPath(arg, "FROM:"), nil, true
+			st.reply(250, "OK")
+		case "RCPT":
+			if !st.inMail {
+				st.reply(503, "Need MAIL first")
+				continue
+			}
+			st.rcpts = append(st.rcpts, smtpPath(arg, "TO:"))
+			st.reply(250, "OK")
+		case "DATA":
+			if len(st.rcpts) == 0 {
+				st.reply(503, "Need RCPT first")
+				continue
+			}
+			st.reply(354, "End data with <CR><LF>.<CR><LF>")
+			data, err := st.tp.ReadDotBytes()
+			if err != nil {
+				return
+			}
+			srv.record(st, data)
+			st.from, st.rcpts, st.inMail = "", nil, false
+			st.reply(250, "OK: message accepted")
+		case "RSET":
+			st.from, st.rcpts, st.inMail = "", nil, false
+			st.reply(250, "OK")
+		case "NOOP":
+			st.reply(250, "OK")
+		case "QUIT":
+			st.reply(221, "Bye")
+			return
+		default:
+			st.reply(502, "Command not implemented")
+		}
+	}
+}
+
+// auth() handles the AUTH command, for the PLAIN and LOGIN mechanisms.
+func (srv *TestServer) auth(st *smtpState, arg string) {
+	if len(st.user) > 0 {
+		st.reply(503, "Already authenticated")
+		return
+	}
+	fields := strings.Fields(arg)
+	if len(fields) == 0 {
+		st.reply(501, "Missing mechanism")
+		return
+	}
+	// challenge() sends a prompt and decodes the client's response
+	challenge := func(prompt string) (string, bool) {
+		st.reply(334, base64.StdEncoding.EncodeToString([]byte(prompt)))
+		line, err := st.tp.ReadLine()
+		if err != nil || line == "*" {
+			return "", false
+		}
+		resp, err := base64.StdEncoding.DecodeString(line)
+		return string(resp), err == nil
+	}
+	var user, pass string
+	switch strings.ToUpper(fields[0]) {
+	case "PLAIN":
+		resp, ok := "", true
+		if len(fields) > 1 {
+			data, err := base64.StdEncoding.DecodeString(fields[1])
+			resp, ok = string(data), err == nil
+		} else {
+			resp, ok = challenge("")
+		}
+		// authorisation identity, user and password, separated by NULs
+		parts := strings.Split(resp, "\x00")
+		if !ok || len(parts) != 3 {
+			st.reply(501, "Malformed AUTH PLAIN response")
+			return
+		}
+		user, pass = parts[1], parts[2]
+	case "LOGIN":
+		var ok bool
+		if user, ok = challenge("Username:"); !ok {
+			st.reply(501, "Malformed AUTH LOGIN response")
+			return
+		}
+		if pass, ok = challenge("Password:"); !ok {
+			st.reply(501, "Malformed AUTH LOGIN response")
+			return
+		}
+	default:
+		st.reply(504, "Unrecognised authentication mechanism")
+		return
+	}
+	if user != srv.User || pass != srv.Pass {
+		st.reply(535, "Authentication credentials invalid")
+		return
+	}
+	st.user = user
+	st.reply(235, "Authentication successful")
+}
+
+// record() stores a message that has been received.
+func (srv *TestServer) record(st *smtpState, data []byte) {
+	// ReadDotBytes() leaves bare LFs - put the CRLFs back
+	data = bytes.ReplaceAll(data, []byte("\n"), []byte("\r\n"))
+	msg, _ := ParseMessage(bytes.NewReader(data))
+	srv.mu.Lock()
+	srv.messages = append(srv.messages, ReceivedMessage{
+		From:    st.from,
+		To:      st.rcpts,
+		Data:    data,
+		Message: msg,
+		User:    st.user,
+		TLS:     st.isTLS,
+	})
+	srv.mu.Unlock()
+}
+
+// smtpPath() extracts the address from a MAIL FROM or RCPT TO argument,
+// ignoring any parameters after it.
+func smtpPath(arg string, prefix string) string {
+	if len(arg) >= len(prefix) && strings.EqualFold(arg[:len(prefix)], prefix) {
+		arg = strings.TrimSpace(arg[len(prefix):])
+	}
+	if i := strings.IndexByte(arg, '>'); i >= 0 {
+		arg = arg[:i]
+	}
+	return strings.TrimPrefix(arg, "<")
+}
+
+// testCertificate() generates a self-signed certificate for the loopback
+// addresses, returning it along with its PEM encoding.
+func testCertificate() (tls.Certificate, []byte, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, nil, fmt.Errorf("Error generating key: %v", err)
+	}
+	serial, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	if err != nil {
+		return tls.Certificate{}, nil, fmt.Errorf("Error generating serial number: %v", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: "emailutils test server"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		DNSNames:              []string{"localhost"},
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, key.Public(), key)
+	if err != nil {
+		return tls.Certificate{}, nil, fmt.Errorf("Error creating certificate: %v", err)
+	}
+	cert := tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+	return cert, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), nil
+}
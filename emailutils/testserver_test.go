@@ -0,0 +1,106 @@
+package emailutils
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+)
+
+// testServerMessage builds a message that exercises encoded headers, both
+// body types, an attachment and every kind of recipient.
+func testServerMessage(t *testing.T) EmailMessage {
+	var msg EmailMessage
+	for _, err := range []error{
+		msg.SetSender("station@example.com"),
+		msg.AddRecipient("Jörg Müller <jorg@example.com>"),
+		msg.AddCc("cc@example.com"),
+		msg.AddBcc("hidden@example.com"),
+	} {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	msg.SetSenderName("Wetterstation Süd")
+	msg.SetSubject("Température élevée – 35°C")
+	msg.BodySet("Temperature is 35°C.\r\n.leading dot\r\n")
+	msg.HTMLSet("<p>Temperature is <b>35°C</b>.</p>")
+	msg.AddAttachment("readings.csv", "text/csv", []byte("time,temp\n12:00,35\n"))
+	return msg
+}
+
+func TestSendEmailTestServer(t *testing.T) {
+	for _, implicitTLS := range []bool{false, true} {
+		srv, err := NewTestServer(implicitTLS)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer srv.Close()
+		msg := testServerMessage(t)
+		if err := msg.SendEmail(srv.Config()); err != nil {
+			t.Fatalf("implicitTLS=%v: %v", implicitTLS, err)
+		}
+		received := srv.Messages()
+		if len(received) != 1 {
+			t.Fatalf("implicitTLS=%v: %d messages received, want 1", implicitTLS, len(received))
+		}
+		got := received[0]
+		if !got.TLS {
+			t.Errorf("implicitTLS=%v: session wasn't encrypted", implicitTLS)
+		}
+		if got.User != srv.User {
+			t.Errorf("implicitTLS=%v: authenticated as %q, want %q", implicitTLS, got.User, srv.User)
+		}
+		if got.From != "station@example.com" {
+			t.Errorf("implicitTLS=%v: envelope sender %q", implicitTLS, got.From)
+		}
+		rcpts := strings.Join(got.To, ",")
+		if rcpts != "jorg@example.com,cc@example.com,hidden@example.com" {
+			t.Errorf("implicitTLS=%v: envelope recipients %q", implicitTLS, rcpts)
+		}
+		if bytes.Contains(bytes.ToLower(got.Data), []byte("\nbcc:")) ||
+			bytes.Contains(got.Data, []byte("hidden@example.com")) {
+			t.Errorf("implicitTLS=%v: Bcc recipient visible in message", implicitTLS)
+		}
+		parsed := got.Message
+		if parsed.Header.Subject != msg.Header.Subject {
+			t.Errorf("implicitTLS=%v: Subject %q, want %q", implicitTLS, parsed.Header.Subject, msg.Header.Subject)
+		}
+		if parsed.Header.Name != msg.Header.Name || parsed.Header.From != msg.Header.From {
+			t.Errorf("implicitTLS=%v: From %q <%s>", implicitTLS, parsed.Header.Name, parsed.Header.From)
+		}
+		if len(parsed.Header.To) != 1 || !strings.Contains(parsed.Header.To[0], "Jörg Müller") {
+			t.Errorf("implicitTLS=%v: To %q", implicitTLS, parsed.Header.To)
+		}
+		if len(parsed.Header.Bcc) != 0 {
+			t.Errorf("implicitTLS=%v: Bcc %q", implicitTLS, parsed.Header.Bcc)
+		}
+		if strings.TrimRight(parsed.Body, "\r\n") != strings.TrimRight(msg.Body, "\r\n") {
+			t.Errorf("implicitTLS=%v: Body %q", implicitTLS, parsed.Body)
+		}
+		if parsed.HTMLBody != msg.HTMLBody {
+			t.Errorf("implicitTLS=%v: HTMLBody %q", implicitTLS, parsed.HTMLBody)
+		}
+		if len(parsed.Attachments) != 1 || parsed.Attachments[0].Filename != "readings.csv" ||
+			!bytes.Equal(parsed.Attachments[0].Data, msg.Attachments[0].Data) {
+			t.Errorf("implicitTLS=%v: Attachments %+v", implicitTLS, parsed.Attachments)
+		}
+	}
+}
+
+func TestTestServerRejectsBadPassword(t *testing.T) {
+	srv, err := NewTestServer(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	cfg := srv.Config()
+	cfg["pass"] = "wrong"
+	err = testServerMessage(t).SendEmail(cfg)
+	if !errors.Is(err, ErrAuth) {
+		t.Fatalf("err = %v, want ErrAuth", err)
+	}
+	if n := len(srv.Messages()); n != 0 {
+		t.Errorf("%d messages accepted", n)
+	}
+}
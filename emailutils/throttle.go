@@ -0,0 +1,391 @@
+/*
+Throttling for emailutils.
+
+A Throttle sits in front of a Transport and stops a flapping sensor from
+flooding inboxes. It applies three rules:
+
+  - each recipient gets at most throttle_recipient_limit messages in any
+    throttle_window
+  - at most throttle_subject_limit messages with the same subject are sent
+    in any throttle_window
+  - a message identical to one sent within throttle_dedup_window is dropped
+
+Anything that is held back is remembered, and a summary is sent to the
+throttle_digest_to addresses every throttle_digest_interval, from
+throttle_digest_from (or, if that's missing, 'user'). The settings go in the
+config map along with everything else:
+
+	throttle_recipient_limit=10
+	throttle_subject_limit=5
+	throttle_window=1h
+	throttle_dedup_window=15m
+	throttle_digest_interval=6h
+	throttle_digest_to=ops@example.com
+	throttle_digest_from=alerts@example.com
+
+A limit of 0 (or leaving the key out) means no limit. Without digest
+addresses, suppressed messages are simply counted.
+*/
+
+package emailutils
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultThrottleWindow = time.Hour
+	// reasons for holding back a message
+	SuppressDuplicate = "duplicate"
+	SuppressSubject   = "subject rate limit"
+	SuppressRecipient = "recipient rate limit"
+)
+
+// Suppressed records messages that a Throttle held back.
+type Suppressed struct {
+	Subject    string
+	Recipients []string
+	Reason     string
+	Count      int
+	First      time.Time
+	Last       time.Time
+}
+
+// Throttle rate-limits and de-duplicates messages before passing them on to
+// a Transport.
+type Throttle struct {
+	Transport      Transport
+	RecipientLimit int           // per recipient, per Window
+	SubjectLimit   int           // per subject, per Window
+	Window         time.Duration // period over which the limits apply
+	DedupWindow    time.Duration // identical messages are dropped in this period
+	DigestInterval time.Duration // how often the digest is sent
+	DigestTo       []string      // where the digest goes
+	DigestFrom     string        // sender of the digest
+
+	mu         sync.Mutex
+	byRcpt     map[string][]time.Time
+	bySubject  map[string][]time.Time
+	lastSeen   map[string]time.Time
+	suppressed map[string]*Suppressed
+	stop       chan struct{}
+	done       chan struct{}
+}
+
+// NewThrottle() creates a Throttle from the throttle_* settings in a config
+// map. Messages are passed on to the Transport selected by the same map.
+// The digest is sent from the address in 'throttle_digest_from', or 'user'
+// if that isn't set.
+func NewThrottle(cfg map[string]string) (*Throttle, error) {
+	var errs = []string{}
+	t := &Throttle{Window: DefaultThrottleWindow, DigestFrom: cfg["user"]}
+	ints := map[string]*int{
+		"throttle_recipient_limit": &t.RecipientLimit,
+		"throttle_subject_limit":   &t.SubjectLimit,
+	}
+	for key, dest := range ints {
+		if v := cfg[key]; len(v) > 0 {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 0 {
+				errs = append(errs, "Invalid config value: "+key)
+			}
+			*dest = n
+		}
+	}
+	durations := map[string]*time.Duration{
+		"throttle_window":          &t.Window,
+		"throttle_dedup_window":    &t.DedupWindow,
+		"throttle_digest_interval": &t.DigestInterval,
+	}
+	for key, dest := range durations {
+		if v := cfg[key]; len(v) > 0 {
+			d, err := time.ParseDuration(v)
+			if err != nil || d < 0 {
+				errs = append(errs, "Invalid config value: "+key)
+			}
+			*dest = d
+		}
+	}
+	for _, addr := range strings.Split(cfg["throttle_digest_to"], ",") {
+		if addr = strings.TrimSpace(addr); len(addr) > 0 {
+			t.DigestTo = append(t.DigestTo, addr)
+		}
+	}
+	if from := cfg["throttle_digest_from"]; len(from) > 0 {
+		if checkAddress("From", from) != nil {
+			errs = append(errs, "Invalid config value: throttle_digest_from")
+		}
+		t.DigestFrom = from
+	}
+	if len(errs) > 0 {
+		sort.Strings(errs)
+		return nil, fmt.Errorf("%w: %s", ErrConfig, strings.Join(errs[:], "; "))
+	}
+	tr, err := NewTransport(cfg)
+	if err != nil {
+		return nil, err
+	}
+	t.Transport = tr
+	return t, nil
+}
+
+// Send() sends the message unless the throttling rules say otherwise.
+// Recipients who have reached their limit aren't sent the message, although
+// the headers are left as they are; if none are left, or the message breaks
+// one of the other rules, it isn't sent at all. The returned bool reports
+// whether anything was sent. A message that fails to send isn't counted, so
+// it can be retried straight away.
+func (t *Throttle) Send(msg EmailMessage) (bool, error) {
+	err := msg.Header.CheckHeaders()
+	if err != nil {
+		return false, err
+	}
+	t.mu.Lock()
+	now := time.Now()
+	t.prune(now)
+	key := messageKey(msg)
+	if t.DedupWindow > 0 {
+		if seen, ok := t.lastSeen[key]; ok && now.Sub(seen) < t.DedupWindow {
+			t.suppress(msg.Header.Subject, msg.Header.Recipients(), SuppressDuplicate, now)
+			t.mu.Unlock()
+			return false, nil
+		}
+	}
+	if t.SubjectLimit > 0 && len(t.bySubject[msg.Header.Subject]) >= t.SubjectLimit {
+		t.suppress(msg.Header.Subject, msg.Header.Recipients(), SuppressSubject, now)
+		t.mu.Unlock()
+		return false, nil
+	}
+	// only the envelope is filtered - moving addresses between the headers
+	// could reveal Bcc recipients
+	rcpts := msg.Header.Recipients()
+	if t.RecipientLimit > 0 {
+		blocked := []string{}
+		kept := []string{}
+		for _, addr := range rcpts {
+			if len(t.byRcpt[strings.ToLower(envelopeAddress(addr))]) >= t.RecipientLimit {
+				blocked = append(blocked, addr)
+			} else {
+				kept = append(kept, addr)
+			}
+		}
+		if len(blocked) > 0 {
+			t.suppress(msg.Header.Subject, blocked, SuppressRecipient, now)
+		}
+		if len(kept) == 0 {
+			t.mu.Unlock()
+			return false, nil
+		}
+		rcpts = kept
+	}
+	// count the message now, so that concurrent sends see it
+	t.lastSeen[key] = now
+	t.bySubject[msg.Header.Subject] = append(t.bySubject[msg.Header.Subject], now)
+	for _, addr := range rcpts {
+		rcpt := strings.ToLower(envelopeAddress(addr))
+		t.byRcpt[rcpt] = append(t.byRcpt[rcpt], now)
+	}
+	t.mu.Unlock()
+	if err = t.Transport.Send(msg.Header.From, rcpts, msg.Bytes()); err != nil {
+		t.uncount(key, msg.Header.Subject, rcpts, now)
+		return false, err
+	}
+	return true, nil
+}
+
+// uncount() undoes the counting of a message that couldn't be sent.
+func (t *Throttle) uncount(key string, subject string, rcpts []string, now time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if seen, ok := t.lastSeen[key]; ok && seen.Equal(now) {
+		delete(t.lastSeen, key)
+	}
+	removeTime(t.bySubject, subject, now)
+	for _, addr := range rcpts {
+		removeTime(t.byRcpt, strings.ToLower(envelopeAddress(addr)), now)
+	}
+}
+
+// removeTime() removes one occurrence of a time from a list in a map.
+func removeTime(counts map[string][]time.Time, key string, tm time.Time) {
+	times := counts[key]
+	for i, seen := range times {
+		if seen.Equal(tm) {
+			times = append(times[:i], times[i+1:]...)
+			break
+		}
+	}
+	if len(times) == 0 {
+		delete(counts, key)
+	} else {
+		counts[key] = times
+	}
+}
+
+// Suppressed() returns a summary of the messages held back since the last
+// digest.
+func (t *Throttle) Suppressed() []Suppressed {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	list := []Suppressed{}
+	for _, s := range t.suppressed {
+		list = append(list, *s)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].First.Before(list[j].First) })
+	return list
+}
+
+// SendDigest() sends a summary of suppressed messages to DigestTo and then
+// forgets them. Nothing is sent if nothing was suppressed.
+func (t *Throttle) SendDigest() error {
+	list := t.Suppressed()
+	if len(list) == 0 || len(t.DigestTo) == 0 {
+		return nil
+	}
+	var digest EmailMessage
+	for _, addr := range t.DigestTo {
+		if err := digest.AddRecipient(addr); err != nil {
+			return err
+		}
+	}
+	if err := digest.SetSender(t.DigestFrom); err != nil {
+		return err
+	}
+	total := 0
+	for _, s := range list {
+		total += s.Count
+	}
+	digest.SetSubject(strconv.Itoa(total) + " suppressed email(s)")
+	digest.BodySet("The following messages were not sent:")
+	for _, s := range list {
+		digest.BodyAppend("")
+		digest.BodyAppend("Subject:    " + s.Subject)
+		digest.BodyAppend("Reason:     " + s.Reason)
+		digest.BodyAppend("Count:      " + strconv.Itoa(s.Count))
+		digest.BodyAppend("Recipients: " + strings.Join(s.Recipients, ", "))
+		digest.BodyAppend("Between:    " + s.First.Format(time.RFC1123Z) +
+			" and " + s.Last.Format(time.RFC1123Z))
+	}
+	// the digest itself is never throttled
+	if err := digest.SendVia(t.Transport); err != nil {
+		return err
+	}
+	t.mu.Lock()
+	for _, s := range list {
+		key := s.Reason + "\x00" + s.Subject
+		if cur, ok := t.suppressed[key]; ok && cur.Count == s.Count {
+			delete(t.suppressed, key)
+		} else if ok {
+			// more arrived while the digest was being sent
+			cur.Count -= s.Count
+		}
+	}
+	t.mu.Unlock()
+	return nil
+}
+
+// Start() launches a background worker that sends the digest every
+// DigestInterval until Stop() is called.
+func (t *Throttle) Start() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.stop != nil || t.DigestInterval <= 0 {
+		return
+	}
+	t.stop = make(chan struct{})
+	t.done = make(chan struct{})
+	go func(stop chan struct{}, done chan struct{}) {
+		defer close(done)
+		ticker := time.NewTicker(t.DigestInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				t.SendDigest()
+			}
+		}
+	}(t.stop, t.done)
+}
+
+// Stop() halts the digest worker.
+func (t *Throttle) Stop() {
+	t.mu.Lock()
+	stop, done := t.stop, t.done
+	t.stop, t.done = nil, nil
+	t.mu.Unlock()
+	if stop != nil {
+		close(stop)
+		<-done
+	}
+}
+
+// suppress() records a message that was held back.
+func (t *Throttle) suppress(subject string, rcpts []string, reason string, now time.Time) {
+	key := reason + "\x00" + subject
+	s, ok := t.suppressed[key]
+	if !ok {
+		s = &Suppressed{Subject: subject, Reason: reason, First: now}
+		t.suppressed[key] = s
+	}
+	for _, addr := range rcpts {
+		if !contains(s.Recipients, addr) {
+			s.Recipients = append(s.Recipients, addr)
+		}
+	}
+	s.Count++
+	s.Last = now
+}
+
+// prune() forgets about sends that are outside the rate and dedup windows.
+// It also sets up the maps the first time it's called.
+func (t *Throttle) prune(now time.Time) {
+	if t.byRcpt == nil {
+		t.byRcpt = map[string][]time.Time{}
+		t.bySubject = map[string][]time.Time{}
+		t.lastSeen = map[string]time.Time{}
+		t.suppressed = map[string]*Suppressed{}
+	}
+	for _, counts := range []map[string][]time.Time{t.byRcpt, t.bySubject} {
+		for key, times := range counts {
+			kept := times[:0]
+			for _, tm := range times {
+				if now.Sub(tm) < t.Window {
+					kept = append(kept, tm)
+				}
+			}
+			if len(kept) == 0 {
+				delete(counts, key)
+			} else {
+				counts[key] = kept
+			}
+		}
+	}
+	for key, seen := range t.lastSeen {
+		if now.Sub(seen) >= t.DedupWindow {
+			delete(t.lastSeen, key)
+		}
+	}
+}
+
+// messageKey() identifies a message by its sender, recipients and content,
+// so that identical messages can be spotted.
+func messageKey(msg EmailMessage) string {
+	rcpts := msg.Header.Recipients()
+	sort.Strings(rcpts)
+	h := sha1.New()
+	h.Write([]byte(msg.Header.From + "\x00" + strings.Join(rcpts, ",") + "\x00" +
+		msg.Header.Subject + "\x00" + msg.Body + "\x00" + msg.HTMLBody))
+	for _, att := range msg.Attachments {
+		h.Write(att.Data)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
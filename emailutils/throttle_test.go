@@ -0,0 +1,92 @@
+package emailutils
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+// flakyTransport fails while down is set, and records what it's given.
+type flakyTransport struct {
+	down  bool
+	calls int
+	sent  []SentMessage
+}
+
+func (f *flakyTransport) Send(from string, to []string, msg []byte) error {
+	f.calls++
+	if f.down {
+		return errors.New("relay down")
+	}
+	f.sent = append(f.sent, SentMessage{From: from, To: to, Data: msg})
+	return nil
+}
+
+func throttleTestMessage(t *testing.T, to []string, bcc []string) EmailMessage {
+	var msg EmailMessage
+	if err := msg.SetSender("station@example.com"); err != nil {
+		t.Fatal(err)
+	}
+	for _, addr := range to {
+		if err := msg.AddRecipient(addr); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, addr := range bcc {
+		if err := msg.AddBcc(addr); err != nil {
+			t.Fatal(err)
+		}
+	}
+	msg.SetSubject("Temperature alert")
+	msg.BodySet("Too hot")
+	return msg
+}
+
+func TestThrottleRetryAfterFailure(t *testing.T) {
+	tr := &flakyTransport{down: true}
+	th := &Throttle{Transport: tr, Window: time.Hour, DedupWindow: time.Hour,
+		SubjectLimit: 1, RecipientLimit: 1}
+	msg := throttleTestMessage(t, []string{"ops@example.com"}, nil)
+	if sent, err := th.Send(msg); sent || err == nil {
+		t.Fatalf("first send: sent=%v err=%v, want an error", sent, err)
+	}
+	tr.down = false
+	if sent, err := th.Send(msg); !sent || err != nil {
+		t.Fatalf("retry: sent=%v err=%v, want it sent", sent, err)
+	}
+	if tr.calls != 2 || len(tr.sent) != 1 {
+		t.Errorf("transport called %d times, %d sent", tr.calls, len(tr.sent))
+	}
+	if list := th.Suppressed(); len(list) != 0 {
+		t.Errorf("suppressed: %+v", list)
+	}
+	// now it has been sent, the same message is a duplicate
+	if sent, err := th.Send(msg); sent || err != nil {
+		t.Fatalf("duplicate: sent=%v err=%v", sent, err)
+	}
+}
+
+func TestThrottleKeepsBccHidden(t *testing.T) {
+	tr := &flakyTransport{}
+	th := &Throttle{Transport: tr, Window: time.Hour, RecipientLimit: 1}
+	first := throttleTestMessage(t, []string{"ops@example.com"}, nil)
+	if _, err := th.Send(first); err != nil {
+		t.Fatal(err)
+	}
+	// ops@ has reached its limit, leaving only the blind copies
+	msg := throttleTestMessage(t, []string{"ops@example.com"},
+		[]string{"secret1@example.com", "secret2@example.com"})
+	msg.SetSubject("Another alert")
+	if sent, err := th.Send(msg); !sent || err != nil {
+		t.Fatalf("sent=%v err=%v", sent, err)
+	}
+	last := tr.sent[len(tr.sent)-1]
+	if strings.Join(last.To, ",") != "secret1@example.com,secret2@example.com" {
+		t.Errorf("envelope recipients %q", last.To)
+	}
+	if bytes.Contains(last.Data, []byte("secret")) {
+		t.Errorf("Bcc recipients visible in message:\n%s", last.Data)
+	}
+}
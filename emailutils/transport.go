@@ -0,0 +1,202 @@
+/*
+Transports for emailutils.
+
+A Transport is whatever actually delivers a rendered message. SendEmail()
+picks one using the 'transport' key in the config map:
+
+	transport=smtp       send via the SMTP server in host/port (the default)
+	transport=memory     record messages in MemoryOutbox - handy for tests
+	transport=maildir    write messages into the maildir given by spool_dir
+	spool_dir=/var/spool/alerts
+
+'spool' is accepted as another name for 'maildir'. Messages can also be sent
+through any Transport directly with EmailMessage.SendVia().
+*/
+
+package emailutils
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Transport is anything capable of delivering a rendered message to a list
+// of recipients.
+type Transport interface {
+	Send(from string, to []string, msg []byte) error
+}
+
+// ContextTransport is a Transport that can also be cancelled or given a
+// deadline through a context.
+type ContextTransport interface {
+	Transport
+	SendContext(ctx context.Context, from string, to []string, msg []byte) error
+}
+
+// SMTPTransport sends messages via an SMTP server. The config map is the
+// same as that used by SendEmail().
+type SMTPTransport struct {
+	Config map[string]string
+}
+
+// Send() delivers the message over SMTP.
+func (t *SMTPTransport) Send(from string, to []string, msg []byte) error {
+	return sendSMTP(context.Background(), t.Config, from, to, msg)
+}
+
+// SendContext() delivers the message over SMTP, giving up if the context
+// is cancelled or its deadline passes.
+func (t *SMTPTransport) SendContext(ctx context.Context, from string, to []string, msg []byte) error {
+	return sendSMTP(ctx, t.Config, from, to, msg)
+}
+
+// SentMessage is a message recorded by a MemoryTransport.
+type SentMessage struct {
+	From string
+	To   []string
+	Data []byte
+}
+
+// MemoryTransport doesn't deliver anything. It simply records the messages
+// it's given, so that code which sends email can be tested.
+type MemoryTransport struct {
+	mu       sync.Mutex
+	messages []SentMessage
+}
+
+// MemoryOutbox is the MemoryTransport used when the config map has
+// transport=memory.
+var MemoryOutbox = &MemoryTransport{}
+
+// Send() records the message.
+func (t *MemoryTransport) Send(from string, to []string, msg []byte) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.messages = append(t.messages, SentMessage{
+		From: from,
+		To:   append([]string(nil), to...),
+		Data: append([]byte(nil), msg...),
+	})
+	return nil
+}
+
+// Messages() returns a copy of the messages recorded so far.
+func (t *MemoryTransport) Messages() []SentMessage {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return append([]SentMessage(nil), t.messages...)
+}
+
+// Reset() discards all recorded messages.
+func (t *MemoryTransport) Reset() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.messages = nil
+}
+
+// SpoolTransport writes each message as a file in a maildir - ie, written
+// to Dir/tmp and then moved into Dir/new once complete. The envelope is
+// recorded in Return-Path and Delivered-To headers at the top of the file.
+type SpoolTransport struct {
+	Dir string
+}
+
+// spoolCounter helps make maildir filenames unique within this process.
+var spoolCounter uint64
+
+// Send() writes the message into the maildir.
+func (t *SpoolTransport) Send(from string, to []string, msg []byte) error {
+	if len(t.Dir) == 0 {
+		return errors.New("No spool directory set")
+	}
+	for _, sub := range []string{"tmp", "new", "cur"} {
+		if err := os.MkdirAll(filepath.Join(t.Dir, sub), 0750); err != nil {
+			return fmt.Errorf("Error creating spool directory: %v", err)
+		}
+	}
+	host, _ := os.Hostname()
+	name := strconv.FormatInt(time.Now().UnixNano(), 10) +
+		".P" + strconv.Itoa(os.Getpid()) +
+		"Q" + strconv.FormatUint(atomic.AddUint64(&spoolCounter, 1), 10) +
+		"." + host
+	tmpPath := filepath.Join(t.Dir, "tmp", name)
+	fh, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0640)
+	if err != nil {
+		return fmt.Errorf("Error creating spool file: %v", err)
+	}
+	envelope := "Return-Path: <" + envelopeAddress(from) + ">\r\n"
+	for _, rcpt := range to {
+		envelope += "Delivered-To: " + envelopeAddress(rcpt) + "\r\n"
+	}
+	_, err = fh.Write(append([]byte(envelope), msg...))
+	if err == nil {
+		err = fh.Sync()
+	}
+	fh.Close()
+	if err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("Error writing spool file: %v", err)
+	}
+	if err = os.Rename(tmpPath, filepath.Join(t.Dir, "new", name)); err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("Error delivering spool file: %v", err)
+	}
+	return nil
+}
+
+// NewTransport() creates the Transport selected by the 'transport' key in
+// the config map. If the map holds DKIM settings, messages are signed before
+// being passed to that transport.
+func NewTransport(cfg map[string]string) (Transport, error) {
+	var t Transport
+	switch cfg["transport"] {
+	case "", "smtp":
+		t = &SMTPTransport{Config: cfg}
+	case "memory":
+		t = MemoryOutbox
+	case "maildir", "spool":
+		if len(cfg["spool_dir"]) == 0 {
+			return nil, fmt.Errorf("%w: Missing config value: spool_dir", ErrConfig)
+		}
+		t = &SpoolTransport{Dir: cfg["spool_dir"]}
+	default:
+		return nil, fmt.Errorf("%w: Unknown transport: %s", ErrConfig, cfg["transport"])
+	}
+	signer, err := NewDKIMSigner(cfg)
+	if err != nil {
+		return nil, err
+	}
+	if signer != nil {
+		t = &dkimTransport{signer: signer, transport: t}
+	}
+	return t, nil
+}
+
+// SendVia() sends the message using the given Transport.
+func (msg EmailMessage) SendVia(t Transport) error {
+	return msg.SendViaContext(context.Background(), t)
+}
+
+// SendViaContext() sends the message using the given Transport. If the
+// Transport is a ContextTransport, the context is passed on to it;
+// otherwise the context is only checked before sending starts.
+func (msg EmailMessage) SendViaContext(ctx context.Context, t Transport) error {
+	err := msg.Header.CheckHeaders()
+	if err != nil {
+		return err
+	}
+	if ct, ok := t.(ContextTransport); ok {
+		return ct.SendContext(ctx, msg.Header.From, msg.Header.Recipients(), msg.Bytes())
+	}
+	if err = ctx.Err(); err != nil {
+		return err
+	}
+	return t.Send(msg.Header.From, msg.Header.Recipients(), msg.Bytes())
+}
@@ -0,0 +1,132 @@
+/*
+Crash-safe file writing for fileutils.
+
+Writing straight to a file with os.Create() truncates it first, so a power
+cut part-way through leaves it empty or half-written. WriteFileAtomic()
+writes to a temporary file in the same directory, flushes it to disk and
+only then renames it over the original, so the file is always either the
+old version or the new one:
+
+	err := fileutils.WriteFileAtomic("/etc/weather.cfg", data, 0644, 2)
+
+The last parameter keeps copies of previous versions - here, the one
+being replaced is kept as weather.cfg.bak and the one before that as
+weather.cfg.bak.1. Use 0 to keep none.
+
+If the path is a symlink, the file it points to is replaced and the link
+is left alone. Where the platform allows, the new version keeps the owner
+and group of the old one.
+*/
+
+package fileutils
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+// WriteFileAtomic - replaces the contents of a file in a way that survives
+// crashes and power cuts. If perm is 0, an existing file keeps its
+// permissions and a new one gets 0644. backups is the number of previous
+// versions to keep, as .bak, .bak.1, .bak.2 and so on.
+func WriteFileAtomic(path string, data []byte, perm os.FileMode, backups int) (err error) {
+	// write next to the real file, so that a symlink isn't replaced
+	if target, linkErr := filepath.EvalSymlinks(path); linkErr == nil {
+		path = target
+	}
+	dir, base := filepath.Split(path)
+	if dir == "" {
+		dir = "."
+	}
+	info, statErr := os.Stat(path)
+	exists := statErr == nil
+	if perm == 0 {
+		perm = 0644
+		if exists {
+			perm = info.Mode().Perm()
+		}
+	}
+	fh, err := os.CreateTemp(dir, "."+base+".tmp-*")
+	if err != nil {
+		return fmt.Errorf("writefileatomic : %v", err)
+	}
+	tmpName := fh.Name()
+	defer func() {
+		if err != nil {
+			fh.Close()
+			os.Remove(tmpName)
+		}
+	}()
+	if _, err = fh.Write(data); err != nil {
+		return fmt.Errorf("writefileatomic : %v", err)
+	}
+	if exists {
+		// before Chmod(), as changing the owner can clear setuid bits
+		keepOwner(fh, info)
+	}
+	if err = fh.Chmod(perm); err != nil {
+		return fmt.Errorf("writefileatomic : %v", err)
+	}
+	if err = fh.Sync(); err != nil {
+		return fmt.Errorf("writefileatomic : %v", err)
+	}
+	if err = fh.Close(); err != nil {
+		return fmt.Errorf("writefileatomic : %v", err)
+	}
+	if exists && backups > 0 {
+		if err = rotateBackups(path, backups); err != nil {
+			return fmt.Errorf("writefileatomic : %v", err)
+		}
+	}
+	if err = os.Rename(tmpName, path); err != nil {
+		return fmt.Errorf("writefileatomic : %v", err)
+	}
+	// make sure the rename itself has reached the disk
+	if err = syncDir(dir); err != nil {
+		return fmt.Errorf("writefileatomic : %v", err)
+	}
+	return nil
+}
+
+// BackupName - returns the name of a backup made by WriteFileAtomic(). 0
+// is the most recent (.bak), 1 the one before (.bak.1) and so on.
+func BackupName(path string, n int) string {
+	if n == 0 {
+		return path + ".bak"
+	}
+	return path + ".bak." + strconv.Itoa(n)
+}
+
+// rotateBackups() moves each backup along one place, dropping the oldest,
+// and makes the current version of the file the newest backup. The current
+// file is hard-linked rather than moved, so it stays in place until the new
+// version replaces it.
+func rotateBackups(path string, backups int) error {
+	os.Remove(BackupName(path, backups-1))
+	for n := backups - 2; n >= 0; n-- {
+		if err := os.Rename(BackupName(path, n), BackupName(path, n+1)); err != nil &&
+			!os.IsNotExist(err) {
+			return err
+		}
+	}
+	if err := os.Link(path, BackupName(path, 0)); err != nil {
+		// not all filesystems support hard links
+		return copyFile(path, BackupName(path, 0))
+	}
+	return nil
+}
+
+// copyFile() copies a file, keeping its permissions.
+func copyFile(src string, dst string) error {
+	info, err := os.Stat(src)
+	if err != nil {
+		return err
+	}
+	data, err := os.ReadFile(src)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(dst, data, info.Mode().Perm())
+}
@@ -0,0 +1,15 @@
+//go:build !unix
+
+package fileutils
+
+import "os"
+
+// keepOwner() does nothing - file ownership works differently outside
+// Unix-like systems.
+func keepOwner(fh *os.File, info os.FileInfo) {}
+
+// syncDir() does nothing, as directories can't be flushed to disk on these
+// platforms. The rename itself is still atomic.
+func syncDir(dir string) error {
+	return nil
+}
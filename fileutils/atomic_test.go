@@ -0,0 +1,35 @@
+package fileutils
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestWriteFileAtomicSymlink(t *testing.T) {
+	dir := t.TempDir()
+	target := filepath.Join(dir, "real.cfg")
+	link := filepath.Join(dir, "weather.cfg")
+	if err := os.WriteFile(target, []byte("a=1\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("real.cfg", link); err != nil {
+		t.Skip("symlinks not supported:", err)
+	}
+	if err := WriteFileAtomic(link, []byte("a=2\n"), 0, 1); err != nil {
+		t.Fatal(err)
+	}
+	if info, err := os.Lstat(link); err != nil || info.Mode()&os.ModeSymlink == 0 {
+		t.Fatalf("symlink replaced: %v %v", info, err)
+	}
+	data, err := os.ReadFile(target)
+	if err != nil || string(data) != "a=2\n" {
+		t.Errorf("target = %q, %v", data, err)
+	}
+	if info, err := os.Stat(target); err != nil || info.Mode().Perm() != 0600 {
+		t.Errorf("permissions not kept: %v %v", info, err)
+	}
+	if data, _ := os.ReadFile(BackupName(target, 0)); string(data) != "a=1\n" {
+		t.Errorf("backup = %q", data)
+	}
+}
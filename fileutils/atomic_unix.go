@@ -0,0 +1,40 @@
+//go:build unix
+
+package fileutils
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+// keepOwner() gives a new file the owner and group of the one it replaces.
+// Only root can give a file away, so this is done where possible and
+// otherwise the new file belongs to whoever wrote it.
+func keepOwner(fh *os.File, info os.FileInfo) {
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return
+	}
+	if int(st.Uid) == os.Geteuid() && int(st.Gid) == os.Getegid() {
+		return
+	}
+	if fh.Chown(int(st.Uid), int(st.Gid)) != nil {
+		// an ordinary user can still change the group to one of their own
+		fh.Chown(-1, int(st.Gid))
+	}
+}
+
+// syncDir() flushes a directory's entries to disk. Filesystems that can't
+// do this report EINVAL, which isn't treated as an error.
+func syncDir(dir string) error {
+	dh, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer dh.Close()
+	if err = dh.Sync(); err != nil && !errors.Is(err, syscall.EINVAL) {
+		return err
+	}
+	return nil
+}
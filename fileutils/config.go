@@ -0,0 +1,371 @@
+/*
+Sectioned config files for fileutils.
+
+Config reads the same key=value files as ReadConfigFile(), with the same
+comment rules, but also understands INI-style [section] headers:
+
+	# settings before any section header are in the top-level section
+	name=weather station
+
+	[mqtt]
+	host=broker.local
+	port=1883
+	topics=sensors/temp, sensors/humidity
+
+	[db]
+	timeout=30s
+
+Values are fetched with typed getters, each of which takes a default that's
+returned if the key is missing or empty. Keys are given as 'section.key',
+or just 'key' for the top-level section:
+
+	cfg, err := fileutils.LoadConfig("/etc/weather.cfg")
+	port, err := cfg.Int("mqtt.port", 1883)
+	timeout, err := cfg.Duration("db.timeout", 10*time.Second)
+	topics := cfg.Strings("mqtt.topics", nil)
+
+If a value can't be converted, the default is returned along with a
+*ConfigValueError saying which key (and line) is at fault.
+*/
+
+package fileutils
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Config - settings read from a config file, grouped into sections.
+type Config struct {
+	sections map[string]*ConfigSection
+	order    []string // section names, in the order first seen
+}
+
+// ConfigSection - the settings in one section of a config file.
+type ConfigSection struct {
+	Name    string
+	entries map[string]ConfigEntry
+	keys    []string // in the order first seen
+}
+
+// ConfigValueError - returned when a value can't be converted to the type
+// asked for.
+type ConfigValueError struct {
+	Key   string // 'section.key', or just 'key' for the top-level section
+	Line  int    // 0 if not known
+	Value string
+	Type  string // eg, "integer"
+}
+
+func (e *ConfigValueError) Error() string {
+	where := ""
+	if e.Line > 0 {
+		where = " (line " + strconv.Itoa(e.Line) + ")"
+	}
+	return "config value " + e.Key + where + " : '" + e.Value + "' is not a valid " + e.Type
+}
+
+// LoadConfig - reads a config file that may contain [section] headers.
+func LoadConfig(filepath string) (*Config, error) {
+	fh, err := os.Open(filepath)
+	if err != nil {
+		return NewConfig(), fmt.Errorf("loadconfig : %v", err)
+	}
+	defer fh.Close()
+	cfg, err := ParseConfig(fh)
+	if err != nil {
+		return cfg, fmt.Errorf("loadconfig : %v", err)
+	}
+	return cfg, nil
+}
+
+// ParseConfig - reads config settings from any reader.
+func ParseConfig(r io.Reader) (*Config, error) {
+	cfg := NewConfig()
+	section := cfg.sections[""]
+	scanner := bufio.NewScanner(r)
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum++
+		line := strings.TrimSpace(scanner.Text())
+		if name, ok := sectionHeader(line); ok {
+			section = cfg.addSection(name)
+			continue
+		}
+		if key, value, ok := parseConfigLine(line); ok {
+			section.set(ConfigEntry{Line: lineNum, Key: key, Value: value})
+		}
+	}
+	return cfg, scanner.Err()
+}
+
+// NewConfig - creates an empty Config, for settings made in code.
+func NewConfig() *Config {
+	cfg := &Config{sections: map[string]*ConfigSection{}}
+	cfg.addSection("")
+	return cfg
+}
+
+// sectionHeader() checks whether a line is a [section] header and, if so,
+// returns the section name.
+func sectionHeader(line string) (string, bool) {
+	if len(line) < 2 || line[0] != '[' || line[len(line)-1] != ']' {
+		return "", false
+	}
+	return strings.TrimSpace(line[1 : len(line)-1]), true
+}
+
+// addSection() returns the named section, creating it if necessary.
+func (c *Config) addSection(name string) *ConfigSection {
+	if s, ok := c.sections[name]; ok {
+		return s
+	}
+	s := &ConfigSection{Name: name, entries: map[string]ConfigEntry{}}
+	c.sections[name] = s
+	c.order = append(c.order, name)
+	return s
+}
+
+// Sections - returns the names of the sections, in the order they appear in
+// the file. The top-level section is "".
+func (c *Config) Sections() []string {
+	return append([]string{}, c.order...)
+}
+
+// Section - returns the named section. A missing section is returned as an
+// empty one, so getters can always be called on the result.
+func (c *Config) Section(name string) *ConfigSection {
+	if s, ok := c.sections[name]; ok {
+		return s
+	}
+	return &ConfigSection{Name: name, entries: map[string]ConfigEntry{}}
+}
+
+// Set - sets a value, creating the section if necessary.
+func (c *Config) Set(key string, value string) {
+	section, name := splitConfigKey(key)
+	c.addSection(section).set(ConfigEntry{Key: name, Value: value})
+}
+
+// Map - returns all the settings as a flat map, with keys in 'section.key'
+// form (or just 'key' for the top-level section).
+func (c *Config) Map() map[string]string {
+	data := make(map[string]string)
+	for _, name := range c.order {
+		s := c.sections[name]
+		for _, key := range s.keys {
+			data[joinConfigKey(name, key)] = s.entries[key].Value
+		}
+	}
+	return data
+}
+
+// lookup() finds the entry for a 'section.key' key. If there's no such
+// section, the whole key is looked for in the top-level section.
+func (c *Config) lookup(key string) (ConfigEntry, bool) {
+	section, name := splitConfigKey(key)
+	if s, ok := c.sections[section]; ok && section != "" {
+		if entry, ok := s.entries[name]; ok {
+			return entry, true
+		}
+	}
+	entry, ok := c.sections[""].entries[key]
+	return entry, ok
+}
+
+// splitConfigKey() splits 'section.key' into its parts.
+func splitConfigKey(key string) (section string, name string) {
+	if idx := strings.Index(key, "."); idx > 0 {
+		return key[:idx], key[idx+1:]
+	}
+	return "", key
+}
+
+// joinConfigKey() is the reverse of splitConfigKey().
+func joinConfigKey(section string, key string) string {
+	if section == "" {
+		return key
+	}
+	return section + "." + key
+}
+
+// set() adds or replaces a setting in the section.
+func (s *ConfigSection) set(entry ConfigEntry) {
+	if _, ok := s.entries[entry.Key]; !ok {
+		s.keys = append(s.keys, entry.Key)
+	}
+	s.entries[entry.Key] = entry
+}
+
+// Keys - returns the keys in the section, in the order they appear.
+func (s *ConfigSection) Keys() []string {
+	return append([]string{}, s.keys...)
+}
+
+// Map - returns the settings in the section.
+func (s *ConfigSection) Map() map[string]string {
+	data := make(map[string]string)
+	for key, entry := range s.entries {
+		data[key] = entry.Value
+	}
+	return data
+}
+
+/******************************************************************************
+ *****   TYPED GETTERS                                                    *****
+ ******************************************************************************/
+
+// Has - reports whether a key has been given a value.
+func (c *Config) Has(key string) bool {
+	entry, ok := c.lookup(key)
+	return ok && len(entry.Value) > 0
+}
+
+// String - returns a value as it is, or def if it's missing or empty.
+func (c *Config) String(key string, def string) string {
+	if entry, ok := c.lookup(key); ok && len(entry.Value) > 0 {
+		return entry.Value
+	}
+	return def
+}
+
+// Int - returns a value as an integer.
+func (c *Config) Int(key string, def int) (int, error) {
+	entry, ok := c.lookup(key)
+	return entryInt(key, entry, ok, def)
+}
+
+// Float - returns a value as a floating-point number.
+func (c *Config) Float(key string, def float64) (float64, error) {
+	entry, ok := c.lookup(key)
+	return entryFloat(key, entry, ok, def)
+}
+
+// Bool - returns a value as a boolean. yes/no, true/false, on/off and 1/0
+// are all understood.
+func (c *Config) Bool(key string, def bool) (bool, error) {
+	entry, ok := c.lookup(key)
+	return entryBool(key, entry, ok, def)
+}
+
+// Duration - returns a value as a time.Duration, written in a form such as
+// 30s, 5m or 1h30m.
+func (c *Config) Duration(key string, def time.Duration) (time.Duration, error) {
+	entry, ok := c.lookup(key)
+	return entryDuration(key, entry, ok, def)
+}
+
+// Strings - returns a comma-separated value as a list, with spaces around
+// each item removed.
+func (c *Config) Strings(key string, def []string) []string {
+	entry, ok := c.lookup(key)
+	return entryStrings(entry, ok, def)
+}
+
+// String - returns a value from the section as it is, or def if it's
+// missing or empty.
+func (s *ConfigSection) String(key string, def string) string {
+	if entry, ok := s.entries[key]; ok && len(entry.Value) > 0 {
+		return entry.Value
+	}
+	return def
+}
+
+// Int - returns a value from the section as an integer.
+func (s *ConfigSection) Int(key string, def int) (int, error) {
+	entry, ok := s.entries[key]
+	return entryInt(joinConfigKey(s.Name, key), entry, ok, def)
+}
+
+// Float - returns a value from the section as a floating-point number.
+func (s *ConfigSection) Float(key string, def float64) (float64, error) {
+	entry, ok := s.entries[key]
+	return entryFloat(joinConfigKey(s.Name, key), entry, ok, def)
+}
+
+// Bool - returns a value from the section as a boolean.
+func (s *ConfigSection) Bool(key string, def bool) (bool, error) {
+	entry, ok := s.entries[key]
+	return entryBool(joinConfigKey(s.Name, key), entry, ok, def)
+}
+
+// Duration - returns a value from the section as a time.Duration.
+func (s *ConfigSection) Duration(key string, def time.Duration) (time.Duration, error) {
+	entry, ok := s.entries[key]
+	return entryDuration(joinConfigKey(s.Name, key), entry, ok, def)
+}
+
+// Strings - returns a comma-separated value from the section as a list.
+func (s *ConfigSection) Strings(key string, def []string) []string {
+	entry, ok := s.entries[key]
+	return entryStrings(entry, ok, def)
+}
+
+func entryInt(key string, entry ConfigEntry, ok bool, def int) (int, error) {
+	if !ok || len(entry.Value) == 0 {
+		return def, nil
+	}
+	n, err := strconv.Atoi(entry.Value)
+	if err != nil {
+		return def, valueError(key, entry, "integer")
+	}
+	return n, nil
+}
+
+func entryFloat(key string, entry ConfigEntry, ok bool, def float64) (float64, error) {
+	if !ok || len(entry.Value) == 0 {
+		return def, nil
+	}
+	f, err := strconv.ParseFloat(entry.Value, 64)
+	if err != nil {
+		return def, valueError(key, entry, "number")
+	}
+	return f, nil
+}
+
+func entryBool(key string, entry ConfigEntry, ok bool, def bool) (bool, error) {
+	if !ok || len(entry.Value) == 0 {
+		return def, nil
+	}
+	switch strings.ToLower(entry.Value) {
+	case "yes", "true", "on", "1":
+		return true, nil
+	case "no", "false", "off", "0":
+		return false, nil
+	}
+	return def, valueError(key, entry, "boolean (use yes/no, true/false, on/off or 1/0)")
+}
+
+func entryDuration(key string, entry ConfigEntry, ok bool, def time.Duration) (time.Duration, error) {
+	if !ok || len(entry.Value) == 0 {
+		return def, nil
+	}
+	d, err := time.ParseDuration(entry.Value)
+	if err != nil {
+		return def, valueError(key, entry, "duration (use a form such as 30s or 5m)")
+	}
+	return d, nil
+}
+
+func entryStrings(entry ConfigEntry, ok bool, def []string) []string {
+	if !ok || len(entry.Value) == 0 {
+		return def
+	}
+	list := []string{}
+	for _, item := range strings.Split(entry.Value, ",") {
+		if item = strings.TrimSpace(item); len(item) > 0 {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+// valueError() creates the error for a value that can't be converted.
+func valueError(key string, entry ConfigEntry, typeName string) error {
+	return &ConfigValueError{Key: key, Line: entry.Line, Value: entry.Value, Type: typeName}
+}
@@ -0,0 +1,295 @@
+/*
+Round-trip config editing for fileutils.
+
+WriteConfigFile() writes a config from scratch, so anything ReadConfigFile()
+skipped - comments, blank lines, the order of the settings - is lost. A
+ConfigDocument keeps the file exactly as it was and changes only the lines
+for the settings that are updated:
+
+	doc, err := fileutils.LoadConfigDocument("/etc/weather.cfg")
+	doc.Set("mqtt.port", "8883")       // updates the line in place
+	doc.Set("mqtt.tls", "yes")         // added after the last mqtt setting
+	doc.Delete("debug")
+	err = doc.Save("/etc/weather.cfg") // replaces the file atomically
+
+Keys work in the same way as for Config: 'section.key', or just 'key' for
+settings before the first [section] header. Setting a key in a section
+that doesn't exist adds the section to the end of the file. Spacing around
+the '=' and the file's line endings are preserved.
+*/
+
+package fileutils
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// ConfigDocument - a config file held line by line, so that it can be
+// edited and written back without disturbing anything else in it.
+type ConfigDocument struct {
+	Backups int // previous versions kept by Save() - see WriteFileAtomic()
+
+	lines   []docLine
+	newline string // line ending used by the file
+	final   bool   // whether the last line ended with a newline
+}
+
+// docLine is a single line of a ConfigDocument.
+type docLine struct {
+	text    string // the line as it appears in the file
+	section string // section the line is in
+	key     string // "" if the line isn't a setting
+	header  bool   // whether this is a [section] header
+	prefix  string // for settings, everything up to the start of the value
+}
+
+// LoadConfigDocument - reads a config file for editing.
+func LoadConfigDocument(filepath string) (*ConfigDocument, error) {
+	fh, err := os.Open(filepath)
+	if err != nil {
+		return NewConfigDocument(), fmt.Errorf("loadconfigdocument : %v", err)
+	}
+	defer fh.Close()
+	doc, err := ParseConfigDocument(fh)
+	if err != nil {
+		return doc, fmt.Errorf("loadconfigdocument : %v", err)
+	}
+	return doc, nil
+}
+
+// ParseConfigDocument - reads a config document from any reader.
+func ParseConfigDocument(r io.Reader) (*ConfigDocument, error) {
+	doc := NewConfigDocument()
+	reader := bufio.NewReader(r)
+	section := ""
+	first := true
+	for {
+		text, err := reader.ReadString('\n')
+		if len(text) == 0 && err != nil {
+			if err == io.EOF {
+				err = nil
+			}
+			return doc, err
+		}
+		doc.final = strings.HasSuffix(text, "\n")
+		if first && strings.HasSuffix(text, "\r\n") {
+			doc.newline = "\r\n"
+		}
+		first = false
+		text = strings.TrimRight(text, "\r\n")
+		line := docLine{text: text, section: section}
+		trimmed := strings.TrimSpace(text)
+		if name, ok := sectionHeader(trimmed); ok {
+			section = name
+			line.section, line.header = name, true
+		} else if key, _, ok := parseConfigLine(trimmed); ok {
+			line.key = key
+			if idx := strings.Index(text, "="); idx >= 0 {
+				// keep the spacing after the '='
+				rest := text[idx+1:]
+				line.prefix = text[:idx+1] + rest[:len(rest)-len(strings.TrimLeft(rest, " \t"))]
+			} else {
+				line.prefix = strings.TrimRight(text, " \t") + "="
+			}
+		}
+		doc.lines = append(doc.lines, line)
+		if err != nil {
+			return doc, nil
+		}
+	}
+}
+
+// NewConfigDocument - creates an empty document.
+func NewConfigDocument() *ConfigDocument {
+	return &ConfigDocument{newline: "\n", final: true}
+}
+
+// find() returns the index of the line holding a setting, or -1. As with
+// ReadConfigFile(), if a key appears more than once the last one counts.
+func (d *ConfigDocument) find(key string) int {
+	match := d.matcher(key)
+	for i := len(d.lines) - 1; i >= 0; i-- {
+		if match(d.lines[i]) {
+			return i
+		}
+	}
+	return -1
+}
+
+// matcher() returns a function that reports whether a line holds the given
+// setting.
+func (d *ConfigDocument) matcher(key string) func(line docLine) bool {
+	section, name := splitConfigKey(key)
+	if section != "" && d.hasSection(section) {
+		return func(line docLine) bool {
+			return line.section == section && line.key == name
+		}
+	}
+	return func(line docLine) bool {
+		return line.section == "" && line.key == key
+	}
+}
+
+// hasSection() reports whether the document has a [section] header for the
+// named section.
+func (d *ConfigDocument) hasSection(section string) bool {
+	for _, line := range d.lines {
+		if line.header && line.section == section {
+			return true
+		}
+	}
+	return false
+}
+
+// Get - returns the value of a setting.
+func (d *ConfigDocument) Get(key string) (string, bool) {
+	if i := d.find(key); i >= 0 {
+		_, value, _ := parseConfigLine(strings.TrimSpace(d.lines[i].text))
+		return value, true
+	}
+	return "", false
+}
+
+// Set - changes the value of a setting, or adds it if it isn't there. The
+// key and value can't contain line breaks, as they would add extra lines to
+// the file.
+func (d *ConfigDocument) Set(key string, value string) error {
+	if strings.ContainsAny(key, "\r\n") || strings.ContainsAny(value, "\r\n") {
+		return fmt.Errorf("setconfigdocument : line break in setting %q", key)
+	}
+	if i := d.find(key); i >= 0 {
+		d.lines[i].text = d.lines[i].prefix + value
+		return nil
+	}
+	section, name := splitConfigKey(key)
+	if section != "" && !d.hasSection(section) && d.hasSectionless(key) {
+		section, name = "", key
+	}
+	line := docLine{text: name + "=" + value, section: section, key: name, prefix: name + "="}
+	if section != "" && !d.hasSection(section) {
+		// a new section goes at the end, separated by a blank line
+		if len(d.lines) > 0 && strings.TrimSpace(d.lines[len(d.lines)-1].text) != "" {
+			d.lines = append(d.lines, docLine{section: d.lines[len(d.lines)-1].section})
+		}
+		d.lines = append(d.lines, docLine{text: "[" + section + "]", section: section, header: true})
+		d.lines = append(d.lines, line)
+		return nil
+	}
+	d.insert(d.insertPoint(section), line)
+	return nil
+}
+
+// hasSectionless() reports whether a dotted key is being used as an
+// ordinary top-level key - ie, there's no such section but a top-level
+// setting with the key exists.
+func (d *ConfigDocument) hasSectionless(key string) bool {
+	for _, line := range d.lines {
+		if line.section == "" && line.key == key {
+			return true
+		}
+	}
+	return false
+}
+
+// insertPoint() decides where a new setting goes in an existing section -
+// after its last setting or, if it has none, straight after the header (or
+// before the first section, for top-level settings).
+func (d *ConfigDocument) insertPoint(section string) int {
+	last := -1
+	for i, line := range d.lines {
+		if line.section == section && (line.key != "" || line.header) {
+			last = i
+		}
+	}
+	if last >= 0 {
+		return last + 1
+	}
+	// a top-level setting in a document without any
+	for i, line := range d.lines {
+		if line.header {
+			// keep any blank lines before the header where they are
+			for i > 0 && strings.TrimSpace(d.lines[i-1].text) == "" {
+				i--
+			}
+			return i
+		}
+	}
+	return len(d.lines)
+}
+
+// insert() adds a line at the given index.
+func (d *ConfigDocument) insert(i int, line docLine) {
+	d.lines = append(d.lines, docLine{})
+	copy(d.lines[i+1:], d.lines[i:])
+	d.lines[i] = line
+}
+
+// Delete - removes a setting, including any earlier copies of it. Returns
+// false if it wasn't there.
+func (d *ConfigDocument) Delete(key string) bool {
+	match := d.matcher(key)
+	kept := d.lines[:0]
+	for _, line := range d.lines {
+		if !match(line) {
+			kept = append(kept, line)
+		}
+	}
+	deleted := len(kept) < len(d.lines)
+	d.lines = kept
+	return deleted
+}
+
+// Keys - returns the keys of all the settings, in 'section.key' form, in the
+// order they appear.
+func (d *ConfigDocument) Keys() []string {
+	keys := []string{}
+	seen := map[string]bool{}
+	for _, line := range d.lines {
+		if line.key == "" {
+			continue
+		}
+		key := joinConfigKey(line.section, line.key)
+		if !seen[key] {
+			keys = append(keys, key)
+			seen[key] = true
+		}
+	}
+	return keys
+}
+
+// Config - returns the settings in the document as a Config.
+func (d *ConfigDocument) Config() *Config {
+	cfg, _ := ParseConfig(bytes.NewReader(d.Bytes()))
+	return cfg
+}
+
+// Bytes - returns the document as it would be written to a file.
+func (d *ConfigDocument) Bytes() []byte {
+	var buf bytes.Buffer
+	for i, line := range d.lines {
+		buf.WriteString(line.text)
+		if i < len(d.lines)-1 || d.final {
+			buf.WriteString(d.newline)
+		}
+	}
+	return buf.Bytes()
+}
+
+// WriteTo - writes the document to w.
+func (d *ConfigDocument) WriteTo(w io.Writer) (int64, error) {
+	n, err := w.Write(d.Bytes())
+	return int64(n), err
+}
+
+// Save - writes the document to a file, atomically.
+func (d *ConfigDocument) Save(filepath string) error {
+	if err := WriteFileAtomic(filepath, d.Bytes(), 0, d.Backups); err != nil {
+		return fmt.Errorf("saveconfigdocument : %v", err)
+	}
+	return nil
+}
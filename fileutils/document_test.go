@@ -0,0 +1,105 @@
+package fileutils
+
+import (
+	"strings"
+	"testing"
+)
+
+const testDocument = "# weather station\r\n" +
+	"debug = no\r\n" +
+	"\r\n" +
+	"[mqtt]\r\n" +
+	"host=broker.local   \r\n" +
+	"port =  1883\r\n" +
+	"\r\n" +
+	"[log]\r\n" +
+	"level=info\r\n" +
+	"level=debug"
+
+func parseTestDocument(t *testing.T) *ConfigDocument {
+	doc, err := ParseConfigDocument(strings.NewReader(testDocument))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return doc
+}
+
+func TestConfigDocumentRoundTrip(t *testing.T) {
+	for _, data := range []string{testDocument, testDocument + "\r\n", "a=1\n\n# end\n", ""} {
+		doc, err := ParseConfigDocument(strings.NewReader(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := string(doc.Bytes()); got != data {
+			t.Errorf("got %q, want %q", got, data)
+		}
+	}
+}
+
+func TestConfigDocumentUpdate(t *testing.T) {
+	doc := parseTestDocument(t)
+	doc.Set("mqtt.port", "8883")
+	doc.Set("debug", "yes")
+	doc.Set("log.level", "warn")
+	want := strings.NewReplacer("port =  1883", "port =  8883", "debug = no", "debug = yes",
+		"level=debug", "level=warn").Replace(testDocument)
+	if got := string(doc.Bytes()); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestConfigDocumentInsert(t *testing.T) {
+	doc := parseTestDocument(t)
+	doc.Set("mqtt.tls", "yes")
+	doc.Set("name", "garden")
+	doc.Set("alerts.email", "me@example.com")
+	want := "# weather station\r\n" +
+		"debug = no\r\n" +
+		"name=garden\r\n" +
+		"\r\n" +
+		"[mqtt]\r\n" +
+		"host=broker.local   \r\n" +
+		"port =  1883\r\n" +
+		"tls=yes\r\n" +
+		"\r\n" +
+		"[log]\r\n" +
+		"level=info\r\n" +
+		"level=debug\r\n" +
+		"\r\n" +
+		"[alerts]\r\n" +
+		"email=me@example.com"
+	if got := string(doc.Bytes()); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestConfigDocumentDelete(t *testing.T) {
+	doc := parseTestDocument(t)
+	if !doc.Delete("log.level") {
+		t.Fatal("log.level not deleted")
+	}
+	if value, ok := doc.Get("log.level"); ok {
+		t.Errorf("log.level still set to %q", value)
+	}
+	if doc.Delete("log.level") {
+		t.Error("deleted log.level twice")
+	}
+	if !strings.HasSuffix(string(doc.Bytes()), "[log]") {
+		t.Errorf("got %q", doc.Bytes())
+	}
+}
+
+func TestConfigDocumentSetLineBreak(t *testing.T) {
+	doc := parseTestDocument(t)
+	for _, value := range []string{"a\nhost=evil", "a\rhost=evil"} {
+		if err := doc.Set("name", value); err == nil {
+			t.Errorf("%q: no error", value)
+		}
+	}
+	if err := doc.Set("a\nb", "c"); err == nil {
+		t.Error("line break in key: no error")
+	}
+	if got := string(doc.Bytes()); got != testDocument {
+		t.Errorf("document changed: %q", got)
+	}
+}
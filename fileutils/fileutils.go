@@ -38,51 +38,83 @@ func ReadConfigFile(filepath string) (data map[string]string, err error) {
 	defer fh.Close()                // make sure the file is closed whatever
 	scanner := bufio.NewScanner(fh) // to read line-by-line
 	for scanner.Scan() {            // iterate over lines in file
-		// Not sure if the TrimSpace() is necessary, but let's be cautious.
-		line := strings.TrimSpace(scanner.Text()) // get next line
-		// Ignore blank lines and comments, otherwise...
-		if len(line) > 0 && !isComment(line) {
-			items := strings.Split(line, "=")
-			key := strings.TrimSpace(items[0])
-			switch len(items) {
-			case 1:
-				// for some reason there was only a key, no value
-				data[key] = ""
-			case 2:
-				// this is what we're expecting
-				data[key] = strings.TrimSpace(items[1])
-			default:
-				// the value may itself have contained one or more '='. Use
-				// the first item as the key and stitch back together
-				// the rest as the value with '=' reinstated.
-				data[key] = strings.TrimSpace(strings.Join(items[1:], "="))
-			}
+		if key, value, ok := parseConfigLine(scanner.Text()); ok {
+			data[key] = value
 		}
 	}
 	return data, err
 }
 
-// WriteConfigFile - writes a map to a file in k=v format.
-// A timestamp entry is added automatically.
-func WriteConfigFile(filepath string, data map[string]string) (lineCount int, err error) {
-	fh, err := os.Create(filepath)
+// ConfigEntry - a single setting from a config file, along with the number
+// of the line it was found on.
+type ConfigEntry struct {
+	Line  int
+	Key   string
+	Value string
+}
+
+// ReadConfigEntries - reads a configuration file in the same way as
+// ReadConfigFile(), but returns the settings in the order they appear,
+// with their line numbers. Useful for reporting errors. If a key appears
+// more than once, so will its entry.
+func ReadConfigEntries(filepath string) (entries []ConfigEntry, err error) {
+	fh, err := os.Open(filepath)
 	if err != nil {
-		return lineCount, err
+		return entries, fmt.Errorf("readcfgentries : %v", err)
 	}
-	defer fh.Sync()
 	defer fh.Close()
-	_, err = fh.WriteString("timestamp=" + FileTimestamp() + "\n")
-	if err != nil {
-		return lineCount, fmt.Errorf("error writing string : %v", err)
+	scanner := bufio.NewScanner(fh)
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum++
+		if key, value, ok := parseConfigLine(scanner.Text()); ok {
+			entries = append(entries, ConfigEntry{Line: lineNum, Key: key, Value: value})
+		}
+	}
+	return entries, scanner.Err()
+}
+
+// parseConfigLine() splits a line from a config file into key and value.
+// Returns false for blank lines and comments.
+func parseConfigLine(text string) (key string, value string, ok bool) {
+	// Not sure if the TrimSpace() is necessary, but let's be cautious.
+	line := strings.TrimSpace(text)
+	// Ignore blank lines and comments, otherwise...
+	if len(line) == 0 || isComment(line) {
+		return key, value, false
+	}
+	items := strings.Split(line, "=")
+	key = strings.TrimSpace(items[0])
+	switch len(items) {
+	case 1:
+		// for some reason there was only a key, no value
+		value = ""
+	case 2:
+		// this is what we're expecting
+		value = strings.TrimSpace(items[1])
+	default:
+		// the value may itself have contained one or more '='. Use
+		// the first item as the key and stitch back together
+		// the rest as the value with '=' reinstated.
+		value = strings.TrimSpace(strings.Join(items[1:], "="))
 	}
+	return key, value, true
+}
+
+// WriteConfigFile - writes a map to a file in k=v format.
+// A timestamp entry is added automatically. The file is replaced atomically
+// - see WriteFileAtomic().
+func WriteConfigFile(filepath string, data map[string]string) (lineCount int, err error) {
+	var buf strings.Builder
+	buf.WriteString("timestamp=" + FileTimestamp() + "\n")
 	lineCount = 1
 	for k, v := range data {
-		_, err = fh.WriteString(k + "=" + v + "\n")
-		if err != nil {
-			return lineCount, fmt.Errorf("writing data string : %v", err)
-		}
+		buf.WriteString(k + "=" + v + "\n")
 		lineCount++
 	}
+	if err = WriteFileAtomic(filepath, []byte(buf.String()), 0, 0); err != nil {
+		return 0, err
+	}
 	return lineCount, err
 }
 
@@ -105,17 +137,14 @@ func ReadPIDFile(filepath string) (pidStr string, err error) {
 }
 
 // WritePIDToFile writes PID of current program to file.
-// Returns string version of that number.
+// Returns string version of that number. The file is replaced atomically.
 func WritePIDToFile(filepath string) (string, error) {
-	fh, err := os.Create(filepath)
+	pidStr := strconv.Itoa(os.Getpid())
+	err := WriteFileAtomic(filepath, []byte(pidStr), 0, 0)
 	if err != nil {
 		return "", err
 	}
-	defer fh.Close()
-	defer fh.Sync()
-	pidStr := strconv.Itoa(os.Getpid())
-	_, err = fh.WriteString(pidStr)
-	return pidStr, err
+	return pidStr, nil
 }
 
 /******************************************************************************
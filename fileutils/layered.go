@@ -0,0 +1,239 @@
+/*
+Layered config for fileutils.
+
+Programs often take their settings from several places - defaults built
+into the code, a system-wide file, the user's own file, the environment and
+the command line. A LayeredConfig reads them all and merges them, with each
+layer overriding the ones before it:
+
+	1. Defaults     built-in values
+	2. SystemFiles  eg, /etc/weather.cfg
+	3. ConfDir      *.cfg files in a directory such as /etc/weather/conf.d,
+	                in name order
+	4. UserFiles    eg, ~/.config/weather/weather.cfg
+	5. Environment  variables starting with EnvPrefix
+	6. Flags        command-line flags that were actually given
+
+For example:
+
+	layers := fileutils.NewLayeredConfig("weather")
+	layers.Defaults = map[string]string{"mqtt.port": "1883"}
+	flag.String("mqtt.host", "", "MQTT broker")
+	flag.Parse()
+	layers.Flags = flag.CommandLine
+	layers.FlagKeys = []string{"mqtt.host"} // -mqtt.port works anyway
+	cfg, sources, err := layers.Load()
+	port, err := cfg.Int("mqtt.port", 1883)
+	// eg, "mqtt.port from /etc/weather.cfg line 12"
+	fmt.Println("mqtt.port from", sources["mqtt.port"])
+
+Files that don't exist are skipped. Keys are in 'section.key' form, as for
+Config. An environment variable's name is the prefix followed by the key in
+capitals, with '__' in place of the '.' - so with the prefix WEATHER_,
+WEATHER_MQTT__PORT sets mqtt.port and WEATHER_DEBUG sets debug. Names are
+matched against the keys already set by the other layers regardless of case,
+so WEATHER_LOGLEVEL overrides a logLevel setting; any other variable with
+the prefix sets a key in lower case.
+
+A flag's name is simply the key. Only flags for keys in Defaults, or listed
+in FlagKeys, are used - so flags such as -v that aren't settings stay out of
+the config.
+*/
+
+package fileutils
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	LayerDefault = "default"
+	LayerSystem  = "system"
+	LayerConfDir = "conf.d"
+	LayerUser    = "user"
+	LayerEnv     = "environment"
+	LayerFlag    = "flag"
+)
+
+// LayeredConfig - where to look for settings. Any of the fields can be left
+// empty.
+type LayeredConfig struct {
+	Defaults    map[string]string
+	SystemFiles []string
+	ConfDir     string
+	UserFiles   []string // a leading ~/ is replaced by the home directory
+	EnvPrefix   string
+	Flags       *flag.FlagSet // must already have been parsed
+	FlagKeys    []string      // flags to use, besides those for keys in Defaults
+}
+
+// ConfigSource - where a setting came from.
+type ConfigSource struct {
+	Layer string // LayerDefault, LayerSystem and so on
+	File  string // for settings from files
+	Line  int    // for settings from files
+	Name  string // environment variable or flag name
+	Value string
+}
+
+// String - describes the source, eg "/etc/weather.cfg line 12".
+func (s ConfigSource) String() string {
+	switch s.Layer {
+	case LayerSystem, LayerConfDir, LayerUser:
+		return s.File + " line " + strconv.Itoa(s.Line)
+	case LayerEnv:
+		return "environment variable " + s.Name
+	case LayerFlag:
+		return "flag -" + s.Name
+	}
+	return s.Layer
+}
+
+// ConfigSources - where each setting came from, by key.
+type ConfigSources map[string]ConfigSource
+
+// Keys - returns the keys, sorted.
+func (s ConfigSources) Keys() []string {
+	keys := make([]string, 0, len(s))
+	for key := range s {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// NewLayeredConfig - creates a LayeredConfig using the usual places for a
+// program called name:
+//
+//	/etc/name.cfg and /etc/name/name.cfg
+//	/etc/name/conf.d/*.cfg
+//	~/.config/name/name.cfg and ~/.name.cfg
+//	NAME_ environment variables
+//
+// Defaults and Flags can then be added.
+func NewLayeredConfig(name string) *LayeredConfig {
+	l := &LayeredConfig{
+		SystemFiles: []string{
+			filepath.Join("/etc", name+".cfg"),
+			filepath.Join("/etc", name, name+".cfg"),
+		},
+		ConfDir:   filepath.Join("/etc", name, "conf.d"),
+		EnvPrefix: strings.ToUpper(strings.ReplaceAll(name, "-", "_")) + "_",
+	}
+	if dir, err := os.UserConfigDir(); err == nil {
+		l.UserFiles = append(l.UserFiles, filepath.Join(dir, name, name+".cfg"))
+	}
+	l.UserFiles = append(l.UserFiles, filepath.Join("~", "."+name+".cfg"))
+	return l
+}
+
+// Load - reads all the layers and merges them. On an error, the settings
+// read so far are returned along with it.
+func (l *LayeredConfig) Load() (*Config, ConfigSources, error) {
+	cfg := NewConfig()
+	sources := ConfigSources{}
+	set := func(key string, src ConfigSource) {
+		cfg.Set(key, src.Value)
+		sources[key] = src
+	}
+	for key, value := range l.Defaults {
+		set(key, ConfigSource{Layer: LayerDefault, Value: value})
+	}
+	if err := l.loadFiles(l.SystemFiles, LayerSystem, set); err != nil {
+		return cfg, sources, err
+	}
+	if l.ConfDir != "" {
+		files, err := filepath.Glob(filepath.Join(l.ConfDir, "*.cfg"))
+		if err != nil {
+			return cfg, sources, fmt.Errorf("loadlayered : %v", err)
+		}
+		sort.Strings(files)
+		if err := l.loadFiles(files, LayerConfDir, set); err != nil {
+			return cfg, sources, err
+		}
+	}
+	if err := l.loadFiles(l.UserFiles, LayerUser, set); err != nil {
+		return cfg, sources, err
+	}
+	if l.EnvPrefix != "" {
+		for _, env := range os.Environ() {
+			name, value, _ := strings.Cut(env, "=")
+			if key, ok := l.envKey(name, sources); ok {
+				set(key, ConfigSource{Layer: LayerEnv, Name: name, Value: value})
+			}
+		}
+	}
+	if l.Flags != nil {
+		keys := map[string]bool{}
+		for key := range l.Defaults {
+			keys[key] = true
+		}
+		for _, key := range l.FlagKeys {
+			keys[key] = true
+		}
+		l.Flags.Visit(func(f *flag.Flag) {
+			if keys[f.Name] {
+				set(f.Name, ConfigSource{Layer: LayerFlag, Name: f.Name, Value: f.Value.String()})
+			}
+		})
+	}
+	return cfg, sources, nil
+}
+
+// EnvName - returns the name of the environment variable for a key.
+func (l *LayeredConfig) EnvName(key string) string {
+	return l.EnvPrefix + strings.ToUpper(strings.ReplaceAll(key, ".", "__"))
+}
+
+// envKey() is the reverse of EnvName(), returning false if the variable
+// doesn't have the prefix. A key that's already known is matched whatever
+// its case.
+func (l *LayeredConfig) envKey(name string, known ConfigSources) (string, bool) {
+	if !strings.HasPrefix(name, l.EnvPrefix) || len(name) == len(l.EnvPrefix) {
+		return "", false
+	}
+	for key := range known {
+		if strings.EqualFold(name, l.EnvName(key)) {
+			return key, true
+		}
+	}
+	return strings.ToLower(strings.ReplaceAll(name[len(l.EnvPrefix):], "__", ".")), true
+}
+
+// loadFiles() reads each of a list of config files, skipping any that
+// don't exist.
+func (l *LayeredConfig) loadFiles(files []string, layer string,
+	set func(key string, src ConfigSource)) error {
+	for _, file := range files {
+		if strings.HasPrefix(file, "~"+string(filepath.Separator)) {
+			home, err := os.UserHomeDir()
+			if err != nil {
+				continue
+			}
+			file = filepath.Join(home, file[2:])
+		}
+		if _, err := os.Stat(file); os.IsNotExist(err) {
+			continue
+		}
+		cfg, err := LoadConfig(file)
+		if err != nil {
+			return fmt.Errorf("loadlayered : %v", err)
+		}
+		for _, name := range cfg.order {
+			s := cfg.sections[name]
+			for _, key := range s.keys {
+				entry := s.entries[key]
+				set(joinConfigKey(name, key), ConfigSource{
+					Layer: layer, File: file, Line: entry.Line, Value: entry.Value,
+				})
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,220 @@
+/*
+Live config reloading for fileutils.
+
+A ConfigWatcher keeps an eye on a config file and re-reads it whenever it
+changes, so a daemon can pick up new settings without being restarted:
+
+	w, err := fileutils.WatchConfig("/etc/weather.cfg", nil)
+	if err != nil { ... }
+	defer w.Close()
+	for change := range w.C {
+		if change.Err != nil {
+			log.Println(change.Err) // change.Config is the last good config
+			continue
+		}
+		for _, key := range change.Changed { ... }
+	}
+
+On Linux, changes are spotted with inotify. Elsewhere (or if inotify isn't
+available), the file is checked every WatchPollInterval. Either way, files
+replaced by renaming - as WriteFileAtomic() and most editors do - are
+handled.
+
+By default, settings are read with LoadConfig(), with keys in 'section.key'
+form. Any other function can be used instead - for example, one that also
+checks the settings, so that a config with mistakes in it is rejected and
+the last good one kept.
+*/
+
+package fileutils
+
+import (
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var (
+	// WatchPollInterval - how often the file is checked when inotify can't
+	// be used.
+	WatchPollInterval = time.Second
+	// WatchSettleTime - how long to wait after a change before reading the
+	// file, so that a burst of writes causes a single reload.
+	WatchSettleTime = 100 * time.Millisecond
+)
+
+// ConfigChange - sent by a ConfigWatcher when the config file changes.
+type ConfigChange struct {
+	Config  map[string]string // the current settings
+	Added   []string          // keys that are new
+	Removed []string          // keys that have gone
+	Changed []string          // keys with a different value
+	Err     error             // if set, the file couldn't be read and Config is unchanged
+}
+
+// ConfigWatcher - watches a config file for changes.
+type ConfigWatcher struct {
+	C <-chan ConfigChange // changes are delivered here
+
+	path    string
+	parse   func(filepath string) (map[string]string, error)
+	mu      sync.Mutex
+	current map[string]string
+	changes chan ConfigChange
+	stop    chan struct{}
+	done    chan struct{}
+	once    sync.Once
+}
+
+// WatchConfig - reads a config file and starts watching it for changes.
+// parse reads the file - if it's nil, LoadConfig() is used. An error is
+// returned if the file can't be read to begin with.
+func WatchConfig(filepath string, parse func(filepath string) (map[string]string, error)) (*ConfigWatcher, error) {
+	if parse == nil {
+		parse = loadConfigMap
+	}
+	changes := make(chan ConfigChange, 1)
+	w := &ConfigWatcher{
+		C:       changes,
+		path:    filepath,
+		parse:   parse,
+		changes: changes,
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	// the watch is set up before the file is first read, so that no change
+	// can slip through in between - and reload() waits for the first read
+	w.mu.Lock()
+	run := w.start()
+	go func() {
+		defer close(w.done)
+		run()
+	}()
+	cfg, err := parse(filepath)
+	w.current = cfg
+	w.mu.Unlock()
+	if err != nil {
+		w.Close()
+		return nil, err
+	}
+	return w, nil
+}
+
+// loadConfigMap() is the default way of reading a watched file.
+func loadConfigMap(filepath string) (map[string]string, error) {
+	cfg, err := LoadConfig(filepath)
+	if err != nil {
+		return nil, err
+	}
+	return cfg.Map(), nil
+}
+
+// Config - returns the current settings.
+func (w *ConfigWatcher) Config() map[string]string {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return copyMap(w.current)
+}
+
+// Close - stops watching the file and closes C. It's safe to call more
+// than once.
+func (w *ConfigWatcher) Close() error {
+	w.once.Do(func() {
+		close(w.stop)
+		<-w.done
+		close(w.changes)
+	})
+	return nil
+}
+
+// reload() reads the file again and reports any changes.
+func (w *ConfigWatcher) reload() {
+	cfg, err := w.parse(w.path)
+	w.mu.Lock()
+	if err != nil {
+		change := ConfigChange{Config: copyMap(w.current), Err: err}
+		w.mu.Unlock()
+		w.send(change)
+		return
+	}
+	added, removed, changed := DiffConfig(w.current, cfg)
+	if len(added)+len(removed)+len(changed) == 0 {
+		w.mu.Unlock()
+		return
+	}
+	w.current = cfg
+	w.mu.Unlock()
+	w.send(ConfigChange{Config: copyMap(cfg), Added: added, Removed: removed, Changed: changed})
+}
+
+// send() delivers a change, unless the watcher is being closed.
+func (w *ConfigWatcher) send(change ConfigChange) {
+	select {
+	case w.changes <- change:
+	case <-w.stop:
+	}
+}
+
+// startPoll() notes the state of the file and returns a function that
+// checks it every WatchPollInterval until the watcher is closed. It's used
+// where inotify isn't available.
+func (w *ConfigWatcher) startPoll() func() {
+	last := fileState(w.path)
+	return func() {
+		ticker := time.NewTicker(WatchPollInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-w.stop:
+				return
+			case <-ticker.C:
+				if state := fileState(w.path); state != last {
+					last = state
+					w.reload()
+				}
+			}
+		}
+	}
+}
+
+// fileState() summarises a file's size and modification time, so that
+// changes can be spotted.
+func fileState(path string) string {
+	info, err := os.Stat(path)
+	if err != nil {
+		return ""
+	}
+	return info.ModTime().String() + "/" + strconv.FormatInt(info.Size(), 10)
+}
+
+// DiffConfig - compares two sets of settings, returning the keys that have
+// been added, removed or changed, each sorted.
+func DiffConfig(old map[string]string, new map[string]string) (added []string, removed []string, changed []string) {
+	for key, value := range new {
+		if oldValue, ok := old[key]; !ok {
+			added = append(added, key)
+		} else if oldValue != value {
+			changed = append(changed, key)
+		}
+	}
+	for key := range old {
+		if _, ok := new[key]; !ok {
+			removed = append(removed, key)
+		}
+	}
+	sort.Strings(added)
+	sort.Strings(removed)
+	sort.Strings(changed)
+	return added, removed, changed
+}
+
+// copyMap() makes a copy of a map, so callers can't change ours.
+func copyMap(m map[string]string) map[string]string {
+	c := make(map[string]string, len(m))
+	for k, v := range m {
+		c[k] = v
+	}
+	return c
+}
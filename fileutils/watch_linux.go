@@ -0,0 +1,109 @@
+/*
+inotify support for ConfigWatcher.
+
+The directory holding the file is watched rather than the file itself, so
+that the watch survives the file being replaced by a rename.
+*/
+
+package fileutils
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+const watchMask = syscall.IN_CLOSE_WRITE | syscall.IN_MODIFY | syscall.IN_CREATE |
+	syscall.IN_DELETE | syscall.IN_MOVED_TO | syscall.IN_MOVED_FROM
+
+// start() sets up an inotify watch for the file and returns the function
+// that waits for its events until the watcher is closed. If inotify can't be
+// used, polling is set up instead.
+func (w *ConfigWatcher) start() func() {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC | syscall.IN_NONBLOCK)
+	if err != nil {
+		return w.startPoll()
+	}
+	dir, base := filepath.Split(w.path)
+	if dir == "" {
+		dir = "."
+	}
+	if _, err := syscall.InotifyAddWatch(fd, dir, watchMask); err != nil {
+		syscall.Close(fd)
+		return w.startPoll()
+	}
+	// being non-blocking, the file uses the runtime's poller - so closing
+	// it wakes up the reader below
+	fh := os.NewFile(uintptr(fd), "inotify")
+	return func() {
+		events := make(chan struct{}, 1)
+		lost := make(chan struct{})
+		go func() {
+			defer close(lost)
+			buf := make([]byte, 64*(syscall.SizeofInotifyEvent+syscall.NAME_MAX+1))
+			for {
+				n, err := fh.Read(buf)
+				if err != nil {
+					return
+				}
+				changed, ok := inotifyEvents(buf[:n], base)
+				if changed {
+					select {
+					case events <- struct{}{}:
+					default: // a reload is already due
+					}
+				}
+				if !ok {
+					return
+				}
+			}
+		}()
+		var settle <-chan time.Time
+		for {
+			select {
+			case <-w.stop:
+				fh.Close()
+				<-lost
+				return
+			case <-events:
+				// wait for the writes to finish before reading the file
+				settle = time.After(WatchSettleTime)
+			case <-settle:
+				settle = nil
+				w.reload()
+			case <-lost:
+				// the directory has gone away, or inotify has failed
+				fh.Close()
+				w.startPoll()()
+				return
+			}
+		}
+	}
+}
+
+// inotifyEvents() goes through a buffer of events, reporting whether any of
+// them were for the named file, and whether the watch is still working.
+func inotifyEvents(buf []byte, name string) (changed bool, ok bool) {
+	ok = true
+	for offset := 0; offset+syscall.SizeofInotifyEvent <= len(buf); {
+		event := (*syscall.InotifyEvent)(unsafe.Pointer(&buf[offset]))
+		start := offset + syscall.SizeofInotifyEvent
+		offset = start + int(event.Len)
+		if offset > len(buf) {
+			break
+		}
+		switch {
+		case event.Mask&syscall.IN_Q_OVERFLOW != 0:
+			// events were missed, so assume the file changed
+			changed = true
+		case event.Mask&(syscall.IN_IGNORED|syscall.IN_DELETE_SELF|syscall.IN_MOVE_SELF) != 0:
+			ok = false
+		case strings.TrimRight(string(buf[start:offset]), "\x00") == name:
+			changed = true
+		}
+	}
+	return changed, ok
+}
@@ -0,0 +1,9 @@
+//go:build !linux
+
+package fileutils
+
+// start() sets up polling for the file - inotify is only available on
+// Linux - and returns the function that does it.
+func (w *ConfigWatcher) start() func() {
+	return w.startPoll()
+}